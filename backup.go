@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,7 +10,6 @@ import (
 	"os"
 	"os/exec"
 	"path"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
@@ -68,9 +68,14 @@ type PostgreSQLDefinition struct {
 	Database string `yaml:"database"`
 }
 
+// DumpCommand is a program writing a dump to stdout. Env holds additional
+// environment variables as "NAME=value". FileType is the extension of the
+// uncompressed dump and defaults to "sql".
 type DumpCommand struct {
-	Program string
-	Args    []string
+	Program  string
+	Args     []string
+	Env      []string
+	FileType string
 }
 
 type Database interface {
@@ -89,7 +94,12 @@ type DatabaseDefinition struct {
 	DockerDefinition      *DockerDefinition      `yaml:"docker"`
 	MySQLDefinition       *MySQLDefinition       `yaml:"mysql"`
 	PostgreSQLDefinition  *PostgreSQLDefinition  `yaml:"postgres"`
+	MongoDBDefinition     *MongoDBDefinition     `yaml:"mongodb"`
+	RedisDefinition       *RedisDefinition       `yaml:"redis"`
+	SQLiteDefinition      *SQLiteDefinition      `yaml:"sqlite"`
+	CommandDefinition     *CommandDefinition     `yaml:"command"`
 	CompressionDefinition *CompressionDefinition `yaml:"compression"`
+	RetryDefinition       *RetryDefinition       `yaml:"retry"`
 }
 
 type VolumeDefinition struct {
@@ -97,42 +107,91 @@ type VolumeDefinition struct {
 	Format                string                 `yaml:"format"`
 	Path                  string                 `yaml:"path"`
 	CompressionDefinition *CompressionDefinition `yaml:"compression"`
+	RetryDefinition       *RetryDefinition       `yaml:"retry"`
 }
 
 type DataProviders struct {
 	DatabaseDefinitions []*DatabaseDefinition `yaml:"databases"`
 	VolumeDefinitions   []*VolumeDefinition   `yaml:"volumes"`
+	GitDefinitions      []*GitDefinition      `yaml:"git"`
+}
+
+// StoredArtifact describes an artifact found on a storage.
+type StoredArtifact struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
 }
 
 type Storage interface {
-	Store(filepath string) error
+	// Store uploads everything read from r as the named artifact. size is
+	// -1 if it is not known in advance.
+	Store(artifact string, r io.Reader, size int64) error
+	// List returns the artifacts in the storage's directory, without
+	// descending into subdirectories.
+	List() ([]StoredArtifact, error)
+	// Fetch writes the contents of the named artifact to w.
+	Fetch(artifact string, w io.Writer) error
+	// Delete removes the named artifact.
+	Delete(artifact string) error
 }
 
-type LocalStorageDefinition struct {
-	Format string `yaml:"format"`
-	Path   string `yaml:"path"`
+// PartialSuffix is appended to the name of an artifact while it is being
+// uploaded by storages which rename it once complete, so an interrupted run
+// never leaves a truncated artifact under its final name.
+const PartialSuffix = ".partial"
+
+// StalePartialAge is how old a partial upload has to be before it is
+// considered abandoned and removed together with expired artifacts.
+const StalePartialAge = 24 * time.Hour
+
+// PartialLister is implemented by storages which upload to a partial name
+// first. List never includes partial uploads; ListPartials returns only them.
+type PartialLister interface {
+	ListPartials() ([]StoredArtifact, error)
 }
 
-type SFTPStorageDefinition struct {
+type LocalStorageDefinition struct {
 	Format string `yaml:"format"`
-	User   string `yaml:"user"`
-	Host   string `yaml:"host"`
 	Path   string `yaml:"path"`
-	Port   int    `yaml:"port"`
-	Key    string `yaml:"key"`
 }
 
 type StorageDefinition struct {
-	Name                   string                  `yaml:"name"`
-	LocalStorageDefinition *LocalStorageDefinition `yaml:"local"`
-	SFTPStorageDefinition  *SFTPStorageDefinition  `yaml:"sftp"`
-	Storage                Storage
+	Name                    string                   `yaml:"name"`
+	LocalStorageDefinition  *LocalStorageDefinition  `yaml:"local"`
+	SFTPStorageDefinition   *SFTPStorageDefinition   `yaml:"sftp"`
+	S3StorageDefinition     *S3StorageDefinition     `yaml:"s3"`
+	WebDAVStorageDefinition *WebDAVStorageDefinition `yaml:"webdav"`
+	FTPStorageDefinition    *FTPStorageDefinition    `yaml:"ftp"`
+	AzureStorageDefinition  *AzureStorageDefinition  `yaml:"azure"`
+	GCSStorageDefinition    *GCSStorageDefinition    `yaml:"gcs"`
+	RcloneStorageDefinition *RcloneStorageDefinition `yaml:"rclone"`
+	RetentionDefinition     *RetentionDefinition     `yaml:"retention"`
+	RetryDefinition         *RetryDefinition         `yaml:"retry"`
+	Verify                  string                   `yaml:"verify"`
+	BandwidthLimit          string                   `yaml:"bandwidth_limit"`
+	BandwidthSchedule       []*BandwidthWindow       `yaml:"bandwidth_schedule"`
+	Storage                 Storage
+
+	bandwidthLimit int64
 }
 
 type Backup struct {
 	Name               string               `yaml:"name"`
 	DataProviders      DataProviders        `yaml:"dataProviders"`
 	StorageDefinitions []*StorageDefinition `yaml:"storageProviders"`
+	// Concurrency limits how many storages are written to at once, 0 means
+	// all of them.
+	Concurrency int `yaml:"concurrency"`
+	// RetryDefinition is used by every data and storage provider which has
+	// none of its own.
+	RetryDefinition *RetryDefinition `yaml:"retry"`
+	// Stream pipes artifacts straight to the storages instead of writing
+	// them to a temporary directory first.
+	Stream bool `yaml:"stream"`
+	// TempDir is where artifacts are written before they are stored, the
+	// system's default temporary directory if empty.
+	TempDir string `yaml:"temp_dir"`
 }
 
 type BackupDefinition struct {
@@ -265,6 +324,13 @@ func analyzeDatabaseDefinition(def *DatabaseDefinition) error {
 		def.CompressionDefinition = DefaultCompressionDefinition()
 	}
 
+	if def.RetryDefinition != nil {
+		err := analyzeRetryDefinition(def.RetryDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid retry definition")
+		}
+	}
+
 	if def.MySQLDefinition != nil {
 		err := analyzeMySQLDefinition(def.MySQLDefinition)
 		if err != nil {
@@ -283,6 +349,46 @@ func analyzeDatabaseDefinition(def *DatabaseDefinition) error {
 		def.SetPrimaryDatabase(def.PostgreSQLDefinition)
 	}
 
+	if def.MongoDBDefinition != nil {
+		err := analyzeMongoDBDefinition(def.MongoDBDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid MongoDB definition")
+		}
+
+		def.SetPrimaryDatabase(def.MongoDBDefinition)
+	}
+
+	if def.RedisDefinition != nil {
+		err := analyzeRedisDefinition(def.RedisDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid Redis definition")
+		}
+
+		def.SetPrimaryDatabase(def.RedisDefinition)
+	}
+
+	if def.SQLiteDefinition != nil {
+		if def.DockerDefinition != nil {
+			return errors.New("docker is not supported for SQLite, use the path of the database on the host")
+		}
+
+		err := analyzeSQLiteDefinition(def.SQLiteDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid SQLite definition")
+		}
+
+		def.SetPrimaryDatabase(def.SQLiteDefinition)
+	}
+
+	if def.CommandDefinition != nil {
+		err := analyzeCommandDefinition(def.CommandDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid command definition")
+		}
+
+		def.SetPrimaryDatabase(def.CommandDefinition)
+	}
+
 	if def.Database == nil {
 		return errors.New("no database specified")
 	}
@@ -312,6 +418,13 @@ func analyzeVolumeDefinition(def *VolumeDefinition) error {
 		def.CompressionDefinition = DefaultCompressionDefinition()
 	}
 
+	if def.RetryDefinition != nil {
+		err := analyzeRetryDefinition(def.RetryDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid retry definition")
+		}
+	}
+
 	// TODO: parse format
 
 	return nil
@@ -334,30 +447,6 @@ func analyzeLocalStorageDefinition(def *LocalStorageDefinition) error {
 	return nil
 }
 
-func analyzeSFTPStorageDefinition(def *SFTPStorageDefinition) error {
-	if len(def.User) == 0 {
-		return errors.New("missing user")
-	}
-
-	if len(def.Host) == 0 {
-		return errors.New("missing host")
-	}
-
-	if len(def.Path) == 0 {
-		return errors.New("missing remote path")
-	}
-
-	// 	if def.Port == 0 {
-	// 		return errors.New("missing port")
-	// 	}
-
-	if def.Port == 0 {
-		def.Port = 22
-	}
-
-	return nil
-}
-
 func analyzeStorageDefinition(def *StorageDefinition) error {
 	if len(def.Name) == 0 {
 		return errors.New("missing name")
@@ -381,12 +470,93 @@ func analyzeStorageDefinition(def *StorageDefinition) error {
 		def.Storage = def.SFTPStorageDefinition
 	}
 
+	if def.Storage == nil && def.S3StorageDefinition != nil {
+		err := analyzeS3StorageDefinition(def.S3StorageDefinition)
+		if err != nil {
+			return errors.Wrapf(err, "invalid S3 storage definition")
+		}
+
+		def.Storage = def.S3StorageDefinition
+	}
+
+	if def.Storage == nil && def.WebDAVStorageDefinition != nil {
+		err := analyzeWebDAVStorageDefinition(def.WebDAVStorageDefinition)
+		if err != nil {
+			return errors.Wrapf(err, "invalid WebDAV storage definition")
+		}
+
+		def.Storage = def.WebDAVStorageDefinition
+	}
+
+	if def.Storage == nil && def.FTPStorageDefinition != nil {
+		err := analyzeFTPStorageDefinition(def.FTPStorageDefinition)
+		if err != nil {
+			return errors.Wrapf(err, "invalid FTP storage definition")
+		}
+
+		def.Storage = def.FTPStorageDefinition
+	}
+
+	if def.Storage == nil && def.AzureStorageDefinition != nil {
+		err := analyzeAzureStorageDefinition(def.AzureStorageDefinition)
+		if err != nil {
+			return errors.Wrapf(err, "invalid Azure storage definition")
+		}
+
+		def.Storage = def.AzureStorageDefinition
+	}
+
+	if def.Storage == nil && def.GCSStorageDefinition != nil {
+		err := analyzeGCSStorageDefinition(def.GCSStorageDefinition)
+		if err != nil {
+			return errors.Wrapf(err, "invalid GCS storage definition")
+		}
+
+		def.Storage = def.GCSStorageDefinition
+	}
+
+	if def.Storage == nil && def.RcloneStorageDefinition != nil {
+		err := analyzeRcloneStorageDefinition(def.RcloneStorageDefinition)
+		if err != nil {
+			return errors.Wrapf(err, "invalid rclone storage definition")
+		}
+
+		def.Storage = def.RcloneStorageDefinition
+	}
+
 	// TODO: parse more storage definitions
 
+	err := analyzeVerifyMode(def)
+	if err != nil {
+		return err
+	}
+
+	if def.RetentionDefinition != nil {
+		err := analyzeRetentionDefinition(def.RetentionDefinition)
+		if err != nil {
+			return errors.Wrapf(err, "invalid retention definition")
+		}
+	}
+
+	if def.RetryDefinition != nil {
+		err := analyzeRetryDefinition(def.RetryDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid retry definition")
+		}
+	}
+
+	err = analyzeBandwidthLimit(def)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func AnalyzeBackupDefinition(def *BackupDefinition) error {
+// AnalyzeStorageDefinitions checks only the storage providers of a backup
+// and their retention policies. This is all that commands working on stored
+// artifacts need, so they can run on a host without the data providers.
+func AnalyzeStorageDefinitions(def *BackupDefinition) error {
 	if def.Version != VERSION {
 		return errors.New("invalid version")
 	}
@@ -396,8 +566,38 @@ func AnalyzeBackupDefinition(def *BackupDefinition) error {
 		return errors.New("backup is missing name")
 	}
 
-	if len(backup.DataProviders.DatabaseDefinitions) == 0 && len(backup.DataProviders.VolumeDefinitions) == 0 {
-		return errors.New("you have neither specified a database or a volume: there is nothing to back up!")
+	if backup.RetryDefinition != nil {
+		err := analyzeRetryDefinition(backup.RetryDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid retry definition")
+		}
+	}
+
+	for _, storageDefinition := range backup.StorageDefinitions {
+		err := analyzeStorageDefinition(storageDefinition)
+		if err != nil {
+			return errors.Wrapf(err, "storage '%s' has invalid definition", storageDefinition.Name)
+		}
+
+		if storageDefinition.RetryDefinition == nil {
+			storageDefinition.RetryDefinition = backup.RetryDefinition
+		}
+	}
+
+	return nil
+}
+
+func AnalyzeBackupDefinition(def *BackupDefinition) error {
+	err := AnalyzeStorageDefinitions(def)
+	if err != nil {
+		return err
+	}
+
+	backup := def.Backup
+
+	if len(backup.DataProviders.DatabaseDefinitions) == 0 && len(backup.DataProviders.VolumeDefinitions) == 0 &&
+		len(backup.DataProviders.GitDefinitions) == 0 {
+		return errors.New("you have neither specified a database, a volume or a git repository: there is nothing to back up!")
 	}
 
 	for _, databaseDefinition := range backup.DataProviders.DatabaseDefinitions {
@@ -405,6 +605,10 @@ func AnalyzeBackupDefinition(def *BackupDefinition) error {
 		if err != nil {
 			return errors.Wrapf(err, "database '%s' has invalid definition", databaseDefinition.Name)
 		}
+
+		if databaseDefinition.RetryDefinition == nil {
+			databaseDefinition.RetryDefinition = backup.RetryDefinition
+		}
 	}
 
 	for _, volumeDefinition := range backup.DataProviders.VolumeDefinitions {
@@ -412,12 +616,35 @@ func AnalyzeBackupDefinition(def *BackupDefinition) error {
 		if err != nil {
 			return errors.Wrapf(err, "volume '%s' has invalid definition", volumeDefinition.Name)
 		}
+
+		if volumeDefinition.RetryDefinition == nil {
+			volumeDefinition.RetryDefinition = backup.RetryDefinition
+		}
 	}
 
-	for _, storageDefinition := range backup.StorageDefinitions {
-		err := analyzeStorageDefinition(storageDefinition)
+	for _, gitDefinition := range backup.DataProviders.GitDefinitions {
+		err := analyzeGitDefinition(gitDefinition)
 		if err != nil {
-			return errors.Wrapf(err, "storage '%s' has invalid definition", storageDefinition.Name)
+			return errors.Wrapf(err, "git '%s' has invalid definition", gitDefinition.Name)
+		}
+
+		if gitDefinition.RetryDefinition == nil {
+			gitDefinition.RetryDefinition = backup.RetryDefinition
+		}
+	}
+
+	if backup.Concurrency < 0 {
+		return errors.New("concurrency must not be negative")
+	}
+
+	if len(backup.TempDir) > 0 {
+		stat, err := os.Stat(backup.TempDir)
+		if err != nil {
+			return errors.Wrap(err, "invalid temp_dir")
+		}
+
+		if !stat.IsDir() {
+			return errors.Errorf("temp_dir %s is not a directory", backup.TempDir)
 		}
 	}
 
@@ -444,12 +671,20 @@ type BackupRunner struct {
 	TempPath string
 	Backup   *Backup
 	Time     time.Time
+
+	pendingBundledRefs map[string]*bundleChain
 }
 
 func NewBackupRunner(Backup *Backup) (*BackupRunner, error) {
-	tmpPath, err := ioutil.TempDir("/tmp", "rika")
-	if err != nil {
-		return nil, err
+	var tmpPath string
+
+	if !Backup.Stream {
+		var err error
+
+		tmpPath, err = ioutil.TempDir(Backup.TempDir, "rika")
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return &BackupRunner{
@@ -506,33 +741,139 @@ func (def *PostgreSQLDefinition) GetDumpCommand() DumpCommand {
 
 func DumpCommandToOSCommand(dumpCmd DumpCommand, def *DatabaseDefinition) *exec.Cmd {
 	if def.DockerDefinition == nil {
-		return exec.Command(dumpCmd.Program, dumpCmd.Args...)
+		cmd := exec.Command(dumpCmd.Program, dumpCmd.Args...)
+		if len(dumpCmd.Env) > 0 {
+			cmd.Env = append(os.Environ(), dumpCmd.Env...)
+		}
+
+		return cmd
 	} else {
-		// prepend docker command
-		dockerArgs := []string{
-			"exec",
-			"-t",
-			def.DockerDefinition.ContainerName,
-			dumpCmd.Program,
+		// prepend docker command, without a TTY as it would mangle binary
+		// dumps
+		dockerArgs := []string{"exec"}
+
+		// Only the names are passed, docker takes the values from its own
+		// environment, which unlike arguments other users cannot read
+		for _, env := range dumpCmd.Env {
+			dockerArgs = append(dockerArgs, "-e", strings.SplitN(env, "=", 2)[0])
 		}
 
+		dockerArgs = append(dockerArgs, def.DockerDefinition.ContainerName, dumpCmd.Program)
+
 		for _, arg := range dumpCmd.Args {
 			dockerArgs = append(dockerArgs, arg)
 		}
 
-		return exec.Command("docker", dockerArgs...)
+		cmd := exec.Command("docker", dockerArgs...)
+		if len(dumpCmd.Env) > 0 {
+			cmd.Env = append(os.Environ(), dumpCmd.Env...)
+		}
+
+		return cmd
 	}
 }
 
-func (runner *BackupRunner) ConstructArtifactName(name, format, filetype, compressionType string) string {
+// ArtifactBaseName is the part of the artifact names of a data provider
+// before the timestamp.
+func ArtifactBaseName(name, format string) string {
 	if len(format) == 0 {
-		name = DefaultFileFormat(name)
+		return DefaultFileFormat(name)
+	}
+
+	return name
+}
+
+func (runner *BackupRunner) ConstructArtifactName(name, format, filetype, compressionType string) string {
+	return fmt.Sprintf("%s-%s.%s.%s", ArtifactBaseName(name, format), runner.GetTimestampString(), filetype, compressionType)
+}
+
+// Artifact is a file generated by a data provider during a run. Size and
+// SHA256 are computed while it is written and used to verify stored copies.
+type Artifact struct {
+	Name   string
+	Size   int64
+	SHA256 []byte
+	// Attempts needed to generate the artifact
+	Attempts int
+}
+
+// ArtifactWriter receives a generated artifact. Close finishes it, Abort
+// discards it after generation failed.
+type ArtifactWriter interface {
+	io.Writer
+	Close() error
+	Abort(err error)
+}
+
+// ArtifactOutput opens the writer for the named artifact.
+type ArtifactOutput func(name string) (ArtifactWriter, error)
+
+type fileArtifactWriter struct {
+	*os.File
+}
+
+func (w fileArtifactWriter) Abort(err error) {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+// FileOutput writes artifacts to files in dir.
+func FileOutput(dir string) ArtifactOutput {
+	return func(name string) (ArtifactWriter, error) {
+		file, err := os.Create(path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+
+		return fileArtifactWriter{file}, nil
+	}
+}
+
+// writeArtifact opens the output for artifact and lets generate write into
+// it, computing the artifact's size and checksum on the way.
+func writeArtifact(output ArtifactOutput, artifact *Artifact, generate func(w io.Writer) error) error {
+	outfile, err := output(artifact.Name)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	writer := bufio.NewWriter(io.MultiWriter(outfile, hash, counter))
+
+	err = generate(writer)
+	if err == nil {
+		err = writer.Flush()
+		if err != nil {
+			err = errors.Wrap(err, "failed writing artifact")
+		}
+	}
+	if err != nil {
+		outfile.Abort(err)
+		return err
+	}
+
+	err = outfile.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed writing artifact")
 	}
 
-	return fmt.Sprintf("%s-%s.%s.%s", name, runner.GetTimestampString(), filetype, compressionType)
+	artifact.Size = counter.n
+	artifact.SHA256 = hash.Sum(nil)
+
+	return nil
 }
 
-func RunCommandWithCompressedStdout(cmd *exec.Cmd, cdef *CompressionDefinition, destPath string) error {
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func RunCommandWithCompressedStdout(cmd *exec.Cmd, cdef *CompressionDefinition, output ArtifactOutput, artifact *Artifact) error {
 	args := []string{"--stdout"}
 
 	for _, additionalArg := range strings.Fields(cdef.Args) {
@@ -564,196 +905,312 @@ func RunCommandWithCompressedStdout(cmd *exec.Cmd, cdef *CompressionDefinition,
 		return err
 	}
 
-	outfile, err := os.Create(destPath)
-	if err != nil {
-		return err
-	}
-	defer outfile.Close()
+	return writeArtifact(output, artifact, func(w io.Writer) error {
+		err := compressCmd.Start()
+		if err != nil {
+			return errors.Wrap(err, "failed to run compression cmd")
+		}
 
-	err = compressCmd.Start()
-	if err != nil {
-		return errors.Wrap(err, "failed to run compression cmd")
-	}
+		err = cmd.Start()
+		if err != nil {
+			compressCmd.Process.Kill()
+			compressCmd.Wait()
+			return errors.Wrap(err, "failed to run cmd")
+		}
 
-	err = cmd.Start()
-	if err != nil {
-		return errors.Wrap(err, "failed to run cmd")
-	}
+		// The output has to be read completely before calling Wait, which
+		// closes the pipe and would otherwise truncate the artifact
+		_, copyErr := io.Copy(w, compressStdout)
+		if copyErr != nil {
+			// Nobody reads the output anymore, which would leave both
+			// commands blocked forever
+			compressCmd.Process.Kill()
+			cmd.Process.Kill()
+		}
 
-	fileWriter := bufio.NewWriter(outfile)
-	go io.Copy(fileWriter, compressStdout)
-	defer fileWriter.Flush()
+		err = compressCmd.Wait()
+		if err != nil && copyErr == nil {
+			return err
+		}
 
-	err = compressCmd.Wait()
-	if err != nil {
-		return err
-	}
+		err = cmd.Wait()
+		if err != nil && copyErr == nil {
+			return err
+		}
 
-	err = cmd.Wait()
-	if err != nil {
-		return err
-	}
+		if copyErr != nil {
+			return errors.Wrap(copyErr, "failed writing artifact")
+		}
 
-	return nil
+		return nil
+	})
 }
 
-func (runner *BackupRunner) GenerateDatabaseArtifact(def *DatabaseDefinition, destPath string, artifactName *string) error {
+func (runner *BackupRunner) GenerateDatabaseArtifact(def *DatabaseDefinition, output ArtifactOutput, artifact *Artifact) error {
+	if def.SQLiteDefinition != nil {
+		return runner.GenerateSQLiteArtifact(def, output, artifact)
+	}
+
 	dumpCmd := def.Database.GetDumpCommand()
 
-	fileName := runner.ConstructArtifactName(def.Name, def.Format, "sql", def.CompressionDefinition.Extension)
-	*artifactName = fileName
-	fullPath := path.Join(destPath, fileName)
+	fileType := dumpCmd.FileType
+	if len(fileType) == 0 {
+		fileType = "sql"
+	}
+
+	fileName := runner.ConstructArtifactName(def.Name, def.Format, fileType, def.CompressionDefinition.Extension)
+	artifact.Name = fileName
 
 	osCmd := DumpCommandToOSCommand(dumpCmd, def)
 
-	return RunCommandWithCompressedStdout(osCmd, def.CompressionDefinition, fullPath)
+	return RunCommandWithCompressedStdout(osCmd, def.CompressionDefinition, output, artifact)
 }
 
-func (runner *BackupRunner) GenerateVolumeArtifact(def *VolumeDefinition, destPath string, artifactName *string) error {
+func (runner *BackupRunner) GenerateVolumeArtifact(def *VolumeDefinition, output ArtifactOutput, artifact *Artifact) error {
+	tarCmd := exec.Command("tar", "cvf", "-", def.Path)
+
+	fileName := runner.ConstructArtifactName(def.Name, def.Format, "tar", def.CompressionDefinition.Extension)
+	artifact.Name = fileName
+
 	if def.CompressionDefinition.Command == "none" {
 		// Simple tar creation
-		fileName := runner.ConstructArtifactName(def.Name, def.Format, "tar", def.CompressionDefinition.Extension)
-		fullPath := path.Join(destPath, fileName)
-		cmd := exec.Command("tar", "cvf", fullPath, def.Path)
-		*artifactName = fileName
-		logVerbose(cmd)
+		logVerbose(tarCmd)
 
-		if !GetOptions().DryRun {
-			return cmd.Run()
+		if GetOptions().DryRun {
+			return nil
 		}
 
-		return nil
-	} else {
-		tarCmd := exec.Command("tar", "cvf", "-", def.Path)
-
-		fileName := runner.ConstructArtifactName(def.Name, def.Format, "tar", def.CompressionDefinition.Extension)
-		*artifactName = fileName
-		fullPath := path.Join(destPath, fileName)
+		tarCmd.Stderr = os.Stderr
 
-		return RunCommandWithCompressedStdout(tarCmd, def.CompressionDefinition, fullPath)
+		return writeArtifact(output, artifact, func(w io.Writer) error {
+			tarCmd.Stdout = w
+			return tarCmd.Run()
+		})
 	}
+
+	return RunCommandWithCompressedStdout(tarCmd, def.CompressionDefinition, output, artifact)
 }
 
-func copy(src, dst string) (int64, error) {
-	sourceFileStat, err := os.Stat(src)
+// writeFile writes everything read from r to dst and syncs it to disk.
+func writeFile(r io.Reader, dst string) (int64, error) {
+	destination, err := os.Create(dst)
 	if err != nil {
 		return 0, err
 	}
+	nBytes, err := io.Copy(destination, r)
+	if err == nil {
+		// Make sure the data is on disk before the file is renamed into place
+		err = destination.Sync()
+	}
+	if err != nil {
+		destination.Close()
+		return nBytes, err
+	}
+	return nBytes, destination.Close()
+}
+
+func (local *LocalStorageDefinition) Store(artifact string, r io.Reader, size int64) error {
+	destFullPath := path.Join(local.Path, artifact)
+	partialPath := destFullPath + PartialSuffix
+
+	//log.Debugf("Local: Copying %s to %s\n", artifact, destFullPath)
 
-	if !sourceFileStat.Mode().IsRegular() {
-		return 0, fmt.Errorf("%s is not a regular file", src)
+	if GetOptions().DryRun {
+		return nil
 	}
 
-	source, err := os.Open(src)
+	_, err := writeFile(r, partialPath)
 	if err != nil {
-		return 0, err
+		os.Remove(partialPath)
+		return err
 	}
-	defer source.Close()
 
-	destination, err := os.Create(dst)
+	return os.Rename(partialPath, destFullPath)
+}
+
+// listFiles returns either the finished artifacts or the partial uploads in
+// the storage's directory.
+func (local *LocalStorageDefinition) listFiles(partial bool) ([]StoredArtifact, error) {
+	files, err := ioutil.ReadDir(local.Path)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer destination.Close()
-	nBytes, err := io.Copy(destination, source)
-	return nBytes, err
+
+	var artifacts []StoredArtifact
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasSuffix(file.Name(), PartialSuffix) != partial {
+			continue
+		}
+
+		artifacts = append(artifacts, StoredArtifact{
+			Name:    file.Name(),
+			Size:    file.Size(),
+			ModTime: file.ModTime(),
+		})
+	}
+
+	return artifacts, nil
 }
 
-func (local *LocalStorageDefinition) Store(fullpath string) error {
-	artifact := filepath.Base(fullpath)
-	destFullPath := path.Join(local.Path, artifact)
+func (local *LocalStorageDefinition) List() ([]StoredArtifact, error) {
+	return local.listFiles(false)
+}
 
-	//log.Debugf("Local: Copying %s to %s\n", fullpath, destFullPath)
+func (local *LocalStorageDefinition) ListPartials() ([]StoredArtifact, error) {
+	return local.listFiles(true)
+}
 
-	if !GetOptions().DryRun {
-		_, err := copy(fullpath, destFullPath)
+func (local *LocalStorageDefinition) Fetch(artifact string, w io.Writer) error {
+	source, err := os.Open(path.Join(local.Path, artifact))
+	if err != nil {
 		return err
 	}
+	defer source.Close()
 
-	return nil
+	_, err = io.Copy(w, source)
+	return err
 }
 
-func (sftp *SFTPStorageDefinition) Store(fullpath string) error {
-	artifact := filepath.Base(fullpath)
+func (local *LocalStorageDefinition) Delete(artifact string) error {
+	fullPath := path.Join(local.Path, artifact)
 
-	var args []string
+	logVerbosef("Local: Deleting %s", fullPath)
 
-	if len(sftp.Key) > 0 {
-		args = []string{fmt.Sprintf("-P%d", sftp.Port), "-o", "UserKnownHostsFile /dev/null", "-o", "StrictHostKeyChecking no", "-i", sftp.Key, fullpath, fmt.Sprintf("%s@%s:%s/%s", sftp.User, sftp.Host, sftp.Path, artifact)}
-	} else {
-		args = []string{fmt.Sprintf("-P%d", sftp.Port), "-o", "UserKnownHostsFile /dev/null", "-o", "StrictHostKeyChecking no", fullpath, fmt.Sprintf("%s@%s:%s/%s", sftp.User, sftp.Host, sftp.Path, artifact)}
+	if GetOptions().DryRun {
+		return nil
 	}
 
-	cmd := exec.Command("scp", args...)
+	return os.Remove(fullPath)
+}
 
-	//log.Debugln(cmd)
+// FetchArtifact downloads an artifact from storage to destPath.
+func FetchArtifact(storage Storage, artifact string, destPath string) error {
+	destination, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
 
-	if !GetOptions().DryRun {
-		if GetOptions().Verbose {
-			cmd.Stderr = os.Stderr
-			cmd.Stdout = os.Stdout
-		}
-		return cmd.Run()
+	err = storage.Fetch(artifact, destination)
+	if err != nil {
+		destination.Close()
+		os.Remove(destPath)
+		return errors.Wrapf(err, "fetching %s failed", artifact)
 	}
 
-	return nil
+	return destination.Close()
 }
 
-func (runner *BackupRunner) Run() error {
-	logVerbosef("Running backup %s", runner.Backup.Name)
+// CloseStorages releases connections that storages keep open across
+// artifacts, e.g. the SSH session of SFTP storage.
+func CloseStorages(storages []*StorageDefinition) {
+	for _, storage := range storages {
+		closer, ok := storage.Storage.(io.Closer)
+		if !ok {
+			continue
+		}
 
-	defer os.RemoveAll(runner.TempPath)
+		err := closer.Close()
+		if err != nil {
+			logVerbosef("Closing storage %s failed: %s", storage.Name, err)
+		}
+	}
+}
 
-	var artifacts []string
+// artifactGenerator produces the artifact of a data provider.
+type artifactGenerator struct {
+	Name     string
+	Retry    *RetryDefinition
+	Generate func(output ArtifactOutput, artifact *Artifact) error
+}
 
-	logVerbose("Generating database artifacts")
+// generators returns the generators of all data providers, databases first
+// and git repositories last.
+func (runner *BackupRunner) generators() []artifactGenerator {
+	var generators []artifactGenerator
 
 	for _, db := range runner.Backup.DataProviders.DatabaseDefinitions {
-		var artifactName string
+		db := db
+		generators = append(generators, artifactGenerator{db.Name, db.RetryDefinition, func(output ArtifactOutput, artifact *Artifact) error {
+			return runner.GenerateDatabaseArtifact(db, output, artifact)
+		}})
+	}
 
-		err := runner.GenerateDatabaseArtifact(db, runner.TempPath, &artifactName)
-		if err != nil {
-			return err
+	for _, volume := range runner.Backup.DataProviders.VolumeDefinitions {
+		volume := volume
+		generators = append(generators, artifactGenerator{volume.Name, volume.RetryDefinition, func(output ArtifactOutput, artifact *Artifact) error {
+			return runner.GenerateVolumeArtifact(volume, output, artifact)
+		}})
+	}
+
+	for _, def := range runner.Backup.DataProviders.GitDefinitions {
+		for _, repo := range def.repositories {
+			def, repo := def, repo
+			generators = append(generators, artifactGenerator{repo.Name, def.RetryDefinition, func(output ArtifactOutput, artifact *Artifact) error {
+				return runner.GenerateGitArtifact(def, repo, output, artifact)
+			}})
 		}
+	}
+
+	return generators
+}
 
-		logVerbosef("Generated: %s", artifactName)
+func (runner *BackupRunner) Run() error {
+	logVerbosef("Running backup %s", runner.Backup.Name)
 
-		if len(artifactName) > 0 {
-			artifacts = append(artifacts, artifactName)
-		}
+	if len(runner.TempPath) > 0 {
+		defer os.RemoveAll(runner.TempPath)
 	}
+	defer CloseStorages(runner.Backup.StorageDefinitions)
 
-	logVerbose("Generating volume artifacts")
+	// Streaming needs room for SQLite copies only
+	err := runner.CheckTempSpace()
+	if err != nil {
+		return err
+	}
 
-	for _, volume := range runner.Backup.DataProviders.VolumeDefinitions {
-		var artifactName string
+	var artifacts []Artifact
+	var results []StorageResult
 
-		err := runner.GenerateVolumeArtifact(volume, runner.TempPath, &artifactName)
+	if runner.Backup.Stream && !GetOptions().DryRun {
+		logVerbose("Streaming artifacts")
+
+		artifacts, results, err = runner.StreamArtifacts()
 		if err != nil {
 			return err
 		}
+	} else {
+		logVerbose("Generating artifacts")
 
-		logVerbosef("Generated: %s", artifactName)
+		for _, generator := range runner.generators() {
+			var artifact Artifact
+			var err error
 
-		if len(artifactName) > 0 {
-			artifacts = append(artifacts, artifactName)
+			artifact.Attempts, err = generator.Retry.Do("Generating "+generator.Name, func() error {
+				return generator.Generate(FileOutput(runner.TempPath), &artifact)
+			})
+			if err != nil {
+				return err
+			}
+
+			logVerbosef("Generated: %s", artifact.Name)
 
+			if len(artifact.Name) > 0 {
+				artifacts = append(artifacts, artifact)
+			}
 		}
-	}
 
-	logVerbose("Storing artifacts")
+		logVerbose("Storing artifacts")
 
-	// Store artifacts
-	for _, storage := range runner.Backup.StorageDefinitions {
-		logVerbosef("Storing into %s", storage.Name)
+		results = runner.StoreArtifacts(artifacts)
+	}
 
-		for _, artifact := range artifacts {
-			artifactFullPath := path.Join(runner.TempPath, artifact)
-			err := storage.Storage.Store(artifactFullPath)
-			if err != nil {
-				return errors.Wrapf(err, "failed storing %s", artifact)
-			}
-		}
+	err = ReportResults(artifacts, results)
+	if err != nil {
+		return err
+	}
+
+	if !GetOptions().DryRun {
+		runner.SaveBundledRefs()
 	}
 
 	logVerbosef("Backup %s done", runner.Backup.Name)
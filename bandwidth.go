@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BandwidthWindow overrides the bandwidth limit of a storage between two
+// times of day. Windows where To is before From span midnight.
+type BandwidthWindow struct {
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	Limit string `yaml:"limit"`
+
+	from  time.Duration
+	to    time.Duration
+	limit int64
+}
+
+var bandwidthRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([KMG]?i?B?)(?:/s)?$`)
+
+var bandwidthUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"K":   1 << 10,
+	"KB":  1000,
+	"KiB": 1 << 10,
+	"M":   1 << 20,
+	"MB":  1000 * 1000,
+	"MiB": 1 << 20,
+	"G":   1 << 30,
+	"GB":  1000 * 1000 * 1000,
+	"GiB": 1 << 30,
+}
+
+// parseBandwidth parses a rate like "10MiB/s" or "500KB/s" into bytes per
+// second. "unlimited" is 0.
+func parseBandwidth(s string) (int64, error) {
+	if s == "unlimited" {
+		return 0, nil
+	}
+
+	match := bandwidthRegexp.FindStringSubmatch(s)
+	if match == nil {
+		return 0, errors.Errorf("invalid bandwidth '%s'", s)
+	}
+
+	unit, ok := bandwidthUnits[match[2]]
+	if !ok {
+		return 0, errors.Errorf("invalid bandwidth unit '%s'", match[2])
+	}
+
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid bandwidth '%s'", s)
+	}
+
+	limit := int64(value * unit)
+	if limit <= 0 {
+		return 0, errors.Errorf("bandwidth '%s' is too low", s)
+	}
+
+	return limit, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into the time since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("invalid time of day '%s', expected HH:MM", s)
+	}
+
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func analyzeBandwidthLimit(def *StorageDefinition) error {
+	if len(def.BandwidthLimit) > 0 {
+		limit, err := parseBandwidth(def.BandwidthLimit)
+		if err != nil {
+			return errors.Wrap(err, "invalid bandwidth_limit")
+		}
+
+		def.bandwidthLimit = limit
+	}
+
+	for i, window := range def.BandwidthSchedule {
+		var err error
+
+		window.from, err = parseTimeOfDay(window.From)
+		if err != nil {
+			return errors.Wrapf(err, "bandwidth_schedule entry %d has invalid from", i+1)
+		}
+
+		window.to, err = parseTimeOfDay(window.To)
+		if err != nil {
+			return errors.Wrapf(err, "bandwidth_schedule entry %d has invalid to", i+1)
+		}
+
+		window.limit, err = parseBandwidth(window.Limit)
+		if err != nil {
+			return errors.Wrapf(err, "bandwidth_schedule entry %d has invalid limit", i+1)
+		}
+	}
+
+	return nil
+}
+
+func (window *BandwidthWindow) contains(timeOfDay time.Duration) bool {
+	if window.from <= window.to {
+		return timeOfDay >= window.from && timeOfDay < window.to
+	}
+
+	return timeOfDay >= window.from || timeOfDay < window.to
+}
+
+// BandwidthLimitAt returns the upload limit in bytes per second at time t,
+// 0 meaning unlimited. The first matching schedule window wins, otherwise
+// bandwidth_limit applies.
+func (def *StorageDefinition) BandwidthLimitAt(t time.Time) int64 {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	timeOfDay := t.Sub(midnight)
+
+	for _, window := range def.BandwidthSchedule {
+		if window.contains(timeOfDay) {
+			return window.limit
+		}
+	}
+
+	return def.bandwidthLimit
+}
+
+// throttledReader limits the rate at which r is read. The limit is looked up
+// on every read so a schedule takes effect during long uploads.
+type throttledReader struct {
+	r     io.Reader
+	limit func() int64
+
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	limit := t.limit()
+	if limit != t.rate {
+		t.rate = limit
+		t.start = time.Now()
+		t.bytes = 0
+	}
+
+	if limit == 0 {
+		return t.r.Read(p)
+	}
+
+	// Read at most a tenth of a second worth of data at once, so the
+	// transfer is smooth instead of bursting
+	if chunk := limit/10 + 1; int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := t.r.Read(p)
+
+	t.bytes += int64(n)
+	expected := time.Duration(float64(t.bytes) / float64(limit) * float64(time.Second))
+	if wait := expected - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return n, err
+}
+
+// throttledFile is a throttledReader for files, which keeps them seekable.
+// It deliberately does not implement io.ReaderAt, as storages such as S3
+// would upload through ReadAt instead of the throttled Read.
+type throttledFile struct {
+	*throttledReader
+	file *os.File
+}
+
+func (t *throttledFile) Seek(offset int64, whence int) (int64, error) {
+	return t.file.Seek(offset, whence)
+}
+
+// Unthrottled gives access to the contents of the file without the limit,
+// to inspect the source, e.g. to resume an upload, rather than to upload it.
+func (t *throttledFile) Unthrottled() io.ReaderAt {
+	return t.file
+}
+
+// throttle wraps r with the storage's bandwidth limit, if it has one.
+func (def *StorageDefinition) throttle(r io.Reader) io.Reader {
+	if def.bandwidthLimit == 0 && len(def.BandwidthSchedule) == 0 {
+		return r
+	}
+
+	throttled := &throttledReader{
+		r:     r,
+		limit: func() int64 { return def.BandwidthLimitAt(time.Now()) },
+	}
+
+	if file, ok := r.(*os.File); ok {
+		return &throttledFile{throttled, file}
+	}
+
+	return throttled
+}
+
+// StoreFile uploads the local file at fullpath to the storage, throttled to
+// its bandwidth limit.
+func (def *StorageDefinition) StoreFile(fullpath string) error {
+	artifact := filepath.Base(fullpath)
+
+	if GetOptions().DryRun {
+		// Nothing has been generated, the provider only logs what it would do
+		return def.Storage.Store(artifact, nil, -1)
+	}
+
+	source, err := os.Open(fullpath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	return def.Storage.Store(artifact, def.throttle(source), stat.Size())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for s, expected := range map[string]int64{
+		"10MiB/s":   10 << 20,
+		"10MB/s":    10 * 1000 * 1000,
+		"512KiB":    512 << 10,
+		"1.5M/s":    3 << 19,
+		"1000":      1000,
+		"2 GiB/s":   2 << 30,
+		"unlimited": 0,
+	} {
+		limit, err := parseBandwidth(s)
+		assert.Nil(t, err, s)
+		assert.Equal(t, expected, limit, s)
+	}
+
+	for _, s := range []string{"", "fast", "10 Mbit/s", "0B/s", "-1MiB/s"} {
+		_, err := parseBandwidth(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	def := &StorageDefinition{
+		Name:                   "Offsite",
+		LocalStorageDefinition: &LocalStorageDefinition{Path: "/tmp"},
+		BandwidthLimit:         "10MiB/s",
+		BandwidthSchedule: []*BandwidthWindow{
+			{From: "08:00", To: "18:00", Limit: "1MiB/s"},
+			{From: "22:00", To: "06:00", Limit: "unlimited"},
+		},
+	}
+	assert.Nil(t, analyzeStorageDefinition(def))
+
+	at := func(hour, minute int) time.Time { return time.Date(2019, 12, 2, hour, minute, 0, 0, time.Local) }
+
+	assert.Equal(t, int64(1<<20), def.BandwidthLimitAt(at(8, 0)))
+	assert.Equal(t, int64(1<<20), def.BandwidthLimitAt(at(17, 59)))
+	assert.Equal(t, int64(10<<20), def.BandwidthLimitAt(at(18, 0)))
+	assert.Equal(t, int64(0), def.BandwidthLimitAt(at(23, 30)))
+	assert.Equal(t, int64(0), def.BandwidthLimitAt(at(5, 0)))
+	assert.Equal(t, int64(10<<20), def.BandwidthLimitAt(at(7, 0)))
+
+	def.BandwidthSchedule = []*BandwidthWindow{{From: "8:00pm", To: "06:00", Limit: "1MiB/s"}}
+	assert.NotNil(t, analyzeStorageDefinition(def))
+}
+
+func TestThrottledReader(t *testing.T) {
+	const size = 256 << 10
+	const limit = 1 << 20
+
+	reader := &throttledReader{
+		r:     bytes.NewReader(make([]byte, size)),
+		limit: func() int64 { return limit },
+	}
+
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, reader)
+	elapsed := time.Since(start)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(size), n)
+	assert.True(t, elapsed >= 200*time.Millisecond, "256KiB at 1MiB/s should take about 250ms, took %s", elapsed)
+	assert.True(t, elapsed < time.Second, "took %s", elapsed)
+}
+
+// readerAtStorage uploads through io.ReaderAt when the source offers it, as
+// minio-go does for S3 uploads of a known size.
+type readerAtStorage struct {
+	slowStorage
+	stored int64
+}
+
+func (s *readerAtStorage) Store(artifact string, r io.Reader, size int64) error {
+	if ra, ok := r.(io.ReaderAt); ok {
+		r = io.NewSectionReader(ra, 0, size)
+	}
+
+	n, err := io.Copy(ioutil.Discard, r)
+	s.stored = n
+	return err
+}
+
+func TestStoreFileThrottlesReaderAtStorages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-bandwidth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const size = 256 << 10
+
+	artifact := path.Join(dir, "db-20191201120000.sql.xz")
+	assert.Nil(t, ioutil.WriteFile(artifact, make([]byte, size), 0644))
+
+	storage := &readerAtStorage{}
+	def := &StorageDefinition{
+		Name:                   "Offsite",
+		LocalStorageDefinition: &LocalStorageDefinition{Path: dir},
+		BandwidthLimit:         "1MiB/s",
+	}
+	assert.Nil(t, analyzeStorageDefinition(def))
+	def.Storage = storage
+
+	start := time.Now()
+	assert.Nil(t, def.StoreFile(artifact))
+	elapsed := time.Since(start)
+
+	assert.Equal(t, int64(size), storage.stored)
+	assert.True(t, elapsed >= 200*time.Millisecond, "256KiB at 1MiB/s should take about 250ms, took %s", elapsed)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CommandDefinition runs an arbitrary program and stores what it writes to
+// stdout, for anything rika has no dedicated provider for, e.g. slapcat.
+// Extension is the file type of the artifact before compression.
+type CommandDefinition struct {
+	Command   string            `yaml:"cmd"`
+	Args      []string          `yaml:"args"`
+	Env       map[string]string `yaml:"env"`
+	Extension string            `yaml:"ext"`
+}
+
+func analyzeCommandDefinition(def *CommandDefinition) error {
+	if len(def.Command) == 0 {
+		return errors.New("missing command")
+	}
+
+	if len(def.Extension) == 0 {
+		return errors.New("missing ext")
+	}
+
+	// Artifact names are parsed by splitting at dots
+	if strings.ContainsAny(def.Extension, "./") {
+		return errors.Errorf("invalid ext '%s'", def.Extension)
+	}
+
+	for name := range def.Env {
+		if len(name) == 0 || strings.Contains(name, "=") {
+			return errors.Errorf("invalid environment variable name '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+func (def *CommandDefinition) GetDumpCommand() DumpCommand {
+	var env []string
+	for name, value := range def.Env {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+
+	return DumpCommand{
+		Program:  def.Command,
+		Args:     def.Args,
+		Env:      env,
+		FileType: def.Extension,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const mongoDBDefaultPort = 27017
+
+// MongoDBDefinition dumps a MongoDB deployment with mongodump into a single
+// archive. Either URI or Host is given; a URI may carry the credentials and
+// options itself, e.g. for replica sets or TLS.
+type MongoDBDefinition struct {
+	URI          string `yaml:"uri"`
+	Host         string `yaml:"host"`
+	Port         int    `yaml:"port"`
+	User         string `yaml:"user"`
+	Password     string `yaml:"password"`
+	Database     string `yaml:"database"`
+	AuthDatabase string `yaml:"auth_database"`
+}
+
+func analyzeMongoDBDefinition(def *MongoDBDefinition) error {
+	if len(def.URI) > 0 {
+		if len(def.Host) > 0 || def.Port != 0 {
+			return errors.New("uri and host are mutually exclusive")
+		}
+	} else {
+		if len(def.Host) == 0 {
+			return errors.New("missing uri or host")
+		}
+
+		if def.Port == 0 {
+			def.Port = mongoDBDefaultPort
+		}
+	}
+
+	if len(def.User) > 0 && len(def.Password) == 0 {
+		return errors.New("missing password")
+	}
+
+	if len(def.AuthDatabase) > 0 && len(def.User) == 0 {
+		return errors.New("auth_database requires a user")
+	}
+
+	// NOTE: we do not check Database, because supplying no database means
+	// we will dump all databases
+
+	return nil
+}
+
+func (def *MongoDBDefinition) GetDumpCommand() DumpCommand {
+	// --archive without a file name writes to stdout
+	args := []string{"--archive"}
+
+	if len(def.URI) > 0 {
+		args = append(args, fmt.Sprintf("--uri=%s", def.URI))
+	} else {
+		args = append(args, "--host", def.Host, "--port", strconv.Itoa(def.Port))
+	}
+
+	if len(def.User) > 0 {
+		args = append(args, "--username", def.User, fmt.Sprintf("--password=%s", def.Password))
+	}
+
+	if len(def.AuthDatabase) > 0 {
+		args = append(args, "--authenticationDatabase", def.AuthDatabase)
+	}
+
+	if len(def.Database) > 0 {
+		args = append(args, "--db", def.Database)
+	}
+
+	return DumpCommand{
+		Program:  "mongodump",
+		Args:     args,
+		FileType: "archive",
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const redisDefaultPort = 6379
+
+// RedisDefinition dumps a Redis server with redis-cli --rdb, which has the
+// server take a consistent snapshot and send it as it would to a replica.
+// Writing it to stdout needs redis-cli 7 or newer, and with ACLs the user has
+// to be allowed to run SYNC/PSYNC. The password is passed in REDISCLI_AUTH,
+// as arguments can be read by any local user.
+type RedisDefinition struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+}
+
+func analyzeRedisDefinition(def *RedisDefinition) error {
+	if len(def.Host) == 0 {
+		return errors.New("missing host")
+	}
+
+	if def.Port == 0 {
+		def.Port = redisDefaultPort
+	}
+
+	if len(def.User) > 0 && len(def.Password) == 0 {
+		return errors.New("missing password")
+	}
+
+	return nil
+}
+
+func (def *RedisDefinition) GetDumpCommand() DumpCommand {
+	args := []string{"-h", def.Host, "-p", strconv.Itoa(def.Port)}
+
+	if len(def.User) > 0 {
+		args = append(args, "--user", def.User)
+	}
+
+	var env []string
+	if len(def.Password) > 0 {
+		env = append(env, "REDISCLI_AUTH="+def.Password)
+	}
+
+	// "-" writes the snapshot to stdout and status messages to stderr
+	args = append(args, "--rdb", "-")
+
+	return DumpCommand{
+		Program:  "redis-cli",
+		Args:     args,
+		Env:      env,
+		FileType: "rdb",
+	}
+}
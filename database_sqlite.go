@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SQLiteDefinition backs up an SQLite database file. Copying the file while
+// it is written to can capture a torn database, so the artifact is made from
+// a consistent copy taken with VACUUM INTO, which is checked with PRAGMA
+// integrity_check first. This needs sqlite3 3.27 or newer. The copy is as
+// large as the database and is made in the temporary directory, even when
+// streaming.
+type SQLiteDefinition struct {
+	Path string `yaml:"path"`
+}
+
+// sqliteDumpScript copies the database $1 to a temporary directory, checks
+// the copy and writes it to stdout. VACUUM INTO gets a relative path, which
+// spares quoting the directory in SQL.
+const sqliteDumpScript = `set -e
+dir=$(mktemp -d "${TMPDIR:-/tmp}/rika-sqlite.XXXXXX")
+trap 'rm -rf "$dir"' EXIT
+cd "$dir"
+sqlite3 -bail "$1" "VACUUM INTO 'copy.sqlite'"
+result=$(sqlite3 -bail copy.sqlite "PRAGMA integrity_check")
+if [ "$result" != ok ]; then
+	echo "copy of $1 is corrupt: $result" >&2
+	exit 1
+fi
+cat copy.sqlite`
+
+func analyzeSQLiteDefinition(def *SQLiteDefinition) error {
+	if len(def.Path) == 0 {
+		return errors.New("missing path")
+	}
+
+	info, err := os.Stat(def.Path)
+	if err != nil {
+		return errors.Wrap(err, "invalid path")
+	}
+
+	if info.IsDir() {
+		return errors.Errorf("%s is a directory", def.Path)
+	}
+
+	// The dump command changes into the directory of the copy
+	def.Path, err = filepath.Abs(def.Path)
+	if err != nil {
+		return errors.Wrap(err, "invalid path")
+	}
+
+	return nil
+}
+
+// GetDumpCommand takes a consistent copy of the database and writes it to
+// stdout. The copy is made in $TMPDIR.
+func (def *SQLiteDefinition) GetDumpCommand() DumpCommand {
+	return DumpCommand{
+		Program:  "sh",
+		Args:     []string{"-c", sqliteDumpScript, "rika-sqlite", def.Path},
+		FileType: "sqlite",
+	}
+}
+
+func (runner *BackupRunner) GenerateSQLiteArtifact(def *DatabaseDefinition, output ArtifactOutput, artifact *Artifact) error {
+	dumpCmd := def.SQLiteDefinition.GetDumpCommand()
+
+	// The copy is made next to the artifacts
+	if len(runner.Backup.TempDir) > 0 {
+		dumpCmd.Env = append(dumpCmd.Env, "TMPDIR="+runner.Backup.TempDir)
+	}
+
+	fileName := runner.ConstructArtifactName(def.Name, def.Format, dumpCmd.FileType, def.CompressionDefinition.Extension)
+	artifact.Name = fileName
+
+	osCmd := DumpCommandToOSCommand(dumpCmd, def)
+
+	return RunCommandWithCompressedStdout(osCmd, def.CompressionDefinition, output, artifact)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// sqlite runs sql on the database at file and returns its output.
+func sqlite(file string, sql string) (string, error) {
+	out, err := exec.Command("sqlite3", "-bail", file, sql).CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "sqlite3 failed: %s", strings.TrimSpace(string(out)))
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func TestSQLiteDefinition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	assert.NotNil(t, analyzeSQLiteDefinition(&SQLiteDefinition{}))
+	assert.NotNil(t, analyzeSQLiteDefinition(&SQLiteDefinition{Path: path.Join(dir, "missing.db")}))
+	assert.NotNil(t, analyzeSQLiteDefinition(&SQLiteDefinition{Path: dir}))
+
+	dbPath := path.Join(dir, "app.db")
+	assert.Nil(t, ioutil.WriteFile(dbPath, nil, 0644))
+
+	def := &DatabaseDefinition{
+		Name:             "App",
+		DockerDefinition: &DockerDefinition{ContainerName: "app"},
+		SQLiteDefinition: &SQLiteDefinition{Path: dbPath},
+	}
+	assert.NotNil(t, analyzeDatabaseDefinition(def), "docker is not supported")
+
+	def.DockerDefinition = nil
+	assert.Nil(t, analyzeDatabaseDefinition(def))
+}
+
+func TestGenerateSQLiteArtifact(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "rika-sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbPath := path.Join(dir, "app.db")
+	_, err = sqlite(dbPath, "PRAGMA journal_mode=WAL; CREATE TABLE test (test int); INSERT INTO test VALUES (1337);")
+	assert.Nil(t, err)
+
+	def := &DatabaseDefinition{
+		Name:                  "App",
+		SQLiteDefinition:      &SQLiteDefinition{Path: dbPath},
+		CompressionDefinition: &CompressionDefinition{Command: "gzip", Extension: "gz"},
+	}
+	assert.Nil(t, analyzeDatabaseDefinition(def))
+
+	runner := &BackupRunner{Backup: &Backup{TempDir: dir}, Time: time.Date(2019, 12, 1, 12, 0, 0, 0, time.UTC)}
+	artifact := &Artifact{}
+	assert.Nil(t, runner.GenerateDatabaseArtifact(def, FileOutput(dir), artifact))
+	assert.Equal(t, "app-20191201120000.sqlite.gz", artifact.Name)
+
+	f, err := os.Open(path.Join(dir, artifact.Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+
+	restored, err := os.Create(path.Join(dir, "restored.db"))
+	assert.Nil(t, err)
+	_, err = io.Copy(restored, r)
+	assert.Nil(t, err)
+	restored.Close()
+
+	result, err := sqlite(restored.Name(), "SELECT test FROM test")
+	assert.Nil(t, err)
+	assert.Equal(t, "1337", result)
+
+	leftovers, err := filepath.Glob(path.Join(dir, "rika-sqlite*"))
+	assert.Nil(t, err)
+	assert.Empty(t, leftovers, "the copy is removed")
+
+	// A corrupt database fails the dump and leaves no copy behind
+	corrupt := path.Join(dir, "corrupt")
+	assert.Nil(t, os.Mkdir(corrupt, 0755))
+	def.SQLiteDefinition.Path = path.Join(dir, artifact.Name)
+	err = runner.GenerateDatabaseArtifact(def, FileOutput(corrupt), &Artifact{})
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "exit status")
+	}
+
+	leftovers, err = filepath.Glob(path.Join(dir, "rika-sqlite*"))
+	assert.Nil(t, err)
+	assert.Empty(t, leftovers, "the copy of a failed dump is removed")
+}
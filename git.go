@@ -0,0 +1,327 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// GitDefinition backs up git repositories as bundles, which unlike archiving
+// a repository as a volume is safe while pushes are running. Path and Paths
+// may be globs matching several repositories, each of which gets its own
+// artifact named after the definition and the repository.
+//
+// Incremental bundles only contain what was added since the refs bundled by
+// the last successful run. Restoring one needs all bundles back to the last
+// full one, which is made every FullEvery runs, whenever those refs are
+// unknown or gone and whenever the backup's storages change.
+type GitDefinition struct {
+	Name                  string                 `yaml:"name"`
+	Format                string                 `yaml:"format"`
+	Path                  string                 `yaml:"path"`
+	Paths                 []string               `yaml:"paths"`
+	Incremental           bool                   `yaml:"incremental"`
+	FullEvery             int                    `yaml:"full_every"`
+	CompressionDefinition *CompressionDefinition `yaml:"compression"`
+	RetryDefinition       *RetryDefinition       `yaml:"retry"`
+
+	repositories []*gitRepository
+}
+
+const defaultGitFullEvery = 30
+
+// incrementalBundleType is the file type of incremental bundles, which
+// retention keeps along with the bundles they build on.
+const incrementalBundleType = IncrementalFileTypePrefix + "bundle"
+
+// gitRepository is a repository matched by a GitDefinition.
+type gitRepository struct {
+	Name   string
+	Path   string
+	GitDir string
+}
+
+// git runs a git command in dir and returns its trimmed output.
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	logVerbose(cmd)
+
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", errors.Wrapf(err, "git failed: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func analyzeGitDefinition(def *GitDefinition) error {
+	if len(def.Name) == 0 {
+		return errors.New("missing name")
+	}
+
+	patterns := def.Paths
+	if len(def.Path) > 0 {
+		patterns = append([]string{def.Path}, patterns...)
+	}
+
+	if len(patterns) == 0 {
+		return errors.New("missing path")
+	}
+
+	// A single repository is named like any other data provider
+	single := len(patterns) == 1 && !strings.ContainsAny(patterns[0], "*?[")
+
+	def.repositories = nil
+	names := make(map[string]string)
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "invalid path %s", pattern)
+		}
+
+		if len(matches) == 0 {
+			return errors.Errorf("%s matches no repository", pattern)
+		}
+
+		for _, match := range matches {
+			gitDir, err := git(match, "rev-parse", "--absolute-git-dir")
+			if err != nil {
+				return errors.Wrapf(err, "%s is not a git repository", match)
+			}
+
+			name := def.Name
+			if !single {
+				name += " " + strings.TrimSuffix(filepath.Base(match), ".git")
+			}
+
+			if other, ok := names[name]; ok {
+				return errors.Errorf("%s and %s would both be named %s", other, match, name)
+			}
+			names[name] = match
+
+			def.repositories = append(def.repositories, &gitRepository{Name: name, Path: match, GitDir: gitDir})
+		}
+	}
+
+	if def.FullEvery < 0 {
+		return errors.New("full_every must be positive")
+	}
+
+	if def.FullEvery > 0 && !def.Incremental {
+		return errors.New("full_every requires incremental")
+	}
+
+	if def.FullEvery == 0 {
+		def.FullEvery = defaultGitFullEvery
+	}
+
+	if def.CompressionDefinition != nil {
+		err := analyzeCompressionDefinition(def.CompressionDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid compression definition")
+		}
+	} else {
+		def.CompressionDefinition = DefaultCompressionDefinition()
+	}
+
+	if def.RetryDefinition != nil {
+		err := analyzeRetryDefinition(def.RetryDefinition)
+		if err != nil {
+			return errors.Wrap(err, "invalid retry definition")
+		}
+	}
+
+	return nil
+}
+
+// bundleChain is the state of the incremental bundles of a repository.
+type bundleChain struct {
+	// Refs of the last bundle
+	Refs []string `yaml:"refs"`
+	// Incrementals is the number of incremental bundles since the last full
+	// one
+	Incrementals int `yaml:"incrementals"`
+	// Storages all bundles of the chain were stored to
+	Storages []string `yaml:"storages"`
+}
+
+// bundledRefsFile is where the chain of the incremental bundles of repo is
+// kept, inside its git directory.
+func (def *GitDefinition) bundledRefsFile(repo *gitRepository) string {
+	return filepath.Join(repo.GitDir, "rika", ArtifactBaseName(repo.Name, def.Format)+".refs")
+}
+
+// readBundleChain returns the chain stored in file, or nil if it does not
+// exist.
+func readBundleChain(file string) (*bundleChain, error) {
+	contents, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	chain := &bundleChain{}
+	err = yaml.Unmarshal(contents, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain, nil
+}
+
+// currentRefs returns the distinct object names all refs of repo point to.
+func currentRefs(repo *gitRepository) ([]string, error) {
+	out, err := git(repo.Path, "for-each-ref", "--format=%(objectname)")
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var refs []string
+
+	for _, ref := range strings.Fields(out) {
+		if !seen[ref] {
+			seen[ref] = true
+			refs = append(refs, ref)
+		}
+	}
+
+	sort.Strings(refs)
+
+	return refs, nil
+}
+
+// storageNames returns the sorted names of the storages of the backup.
+func (runner *BackupRunner) storageNames() []string {
+	var storages []string
+
+	if runner.Backup != nil {
+		for _, storage := range runner.Backup.StorageDefinitions {
+			storages = append(storages, storage.Name)
+		}
+	}
+
+	sort.Strings(storages)
+
+	return storages
+}
+
+// containsAll reports whether every string of want is in have.
+func containsAll(have, want []string) bool {
+	set := make(map[string]bool)
+	for _, s := range have {
+		set[s] = true
+	}
+
+	for _, s := range want {
+		if !set[s] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (runner *BackupRunner) GenerateGitArtifact(def *GitDefinition, repo *gitRepository, output ArtifactOutput, artifact *Artifact) error {
+	refs, err := currentRefs(repo)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading refs of %s", repo.Path)
+	}
+
+	if len(refs) == 0 {
+		log.Printf("%s: repository is empty, nothing to bundle", repo.Name)
+		return nil
+	}
+
+	args := []string{"-C", repo.Path, "bundle", "create", "-", "--all"}
+	fileType := "bundle"
+
+	if def.Incremental {
+		stateFile := def.bundledRefsFile(repo)
+
+		previous, err := readBundleChain(stateFile)
+		if err != nil {
+			log.Printf("%s: could not read last bundled refs, creating a full bundle: %s", repo.Name, err)
+			previous = nil
+		}
+
+		next := &bundleChain{Refs: refs, Storages: runner.storageNames()}
+
+		if previous != nil && len(previous.Refs) > 0 {
+			revListArgs := append([]string{"rev-list", "-n", "1", "--all", "--not"}, previous.Refs...)
+			newCommit, err := git(repo.Path, revListArgs...)
+
+			switch {
+			case err != nil:
+				log.Printf("%s: last bundled refs are gone, creating a full bundle", repo.Name)
+			case !containsAll(previous.Storages, next.Storages):
+				// Storages added since would lack the bundles before
+				log.Printf("%s: storages changed since the last bundle, creating a full bundle", repo.Name)
+			case len(newCommit) == 0:
+				log.Printf("%s: no new commits since the last bundle", repo.Name)
+				return nil
+			case previous.Incrementals >= def.FullEvery:
+				log.Printf("%s: %d incremental bundles since the last full one, creating a full bundle", repo.Name, previous.Incrementals)
+			default:
+				for _, ref := range previous.Refs {
+					args = append(args, "^"+ref)
+				}
+
+				next.Incrementals = previous.Incrementals + 1
+				fileType = incrementalBundleType
+			}
+		}
+
+		runner.bundledRefs(stateFile, next)
+	}
+
+	artifact.Name = runner.ConstructArtifactName(repo.Name, def.Format, fileType, def.CompressionDefinition.Extension)
+
+	return RunCommandWithCompressedStdout(exec.Command("git", args...), def.CompressionDefinition, output, artifact)
+}
+
+// bundledRefs remembers the chain of an incremental bundle until the run
+// has succeeded.
+func (runner *BackupRunner) bundledRefs(file string, chain *bundleChain) {
+	if runner.pendingBundledRefs == nil {
+		runner.pendingBundledRefs = make(map[string]*bundleChain)
+	}
+
+	runner.pendingBundledRefs[file] = chain
+}
+
+// SaveBundledRefs records the refs of the incremental bundles of a run, so
+// the next run only bundles what was added since. It must only be called
+// once all artifacts have been stored, otherwise a failed run would leave a
+// gap. Failing to save is not fatal, the next bundles only get larger.
+func (runner *BackupRunner) SaveBundledRefs() {
+	for file, chain := range runner.pendingBundledRefs {
+		contents, err := yaml.Marshal(chain)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(file), 0755)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(file, contents, 0644)
+		}
+
+		if err != nil {
+			log.Printf("Could not save bundled refs to %s: %s", file, err)
+		}
+	}
+
+	runner.pendingBundledRefs = nil
+}
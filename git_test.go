@@ -0,0 +1,186 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// commitTo pushes a new commit to the bare repository at remote.
+func commitTo(t *testing.T, remote string, message string) string {
+	work, err := ioutil.TempDir("", "rika-git-work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(work)
+
+	for _, args := range [][]string{
+		{"clone", "-q", remote, "."},
+		{"-c", "user.name=rika", "-c", "user.email=rika@localhost", "commit", "-q", "--allow-empty", "-m", message},
+		{"push", "-q", "origin", "HEAD:refs/heads/master"},
+	} {
+		_, err := git(work, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	head, err := git(work, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return head
+}
+
+// bundleHeader returns the header of a gzipped bundle, which lists its
+// prerequisites and refs.
+func bundleHeader(t *testing.T, file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.SplitN(string(contents), "\n\n", 2)[0]
+}
+
+func TestGitDefinition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.git", "b.git"} {
+		_, err := git(dir, "init", "-q", "--bare", name)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, os.Mkdir(path.Join(dir, "plain"), 0755))
+
+	def := &GitDefinition{Name: "Repos", Path: path.Join(dir, "*.git")}
+	assert.Nil(t, analyzeGitDefinition(def))
+	if assert.Len(t, def.repositories, 2) {
+		assert.Equal(t, "Repos a", def.repositories[0].Name)
+		assert.Equal(t, path.Join(dir, "b.git"), def.repositories[1].GitDir)
+	}
+
+	def = &GitDefinition{Name: "Repo", Path: path.Join(dir, "a.git")}
+	assert.Nil(t, analyzeGitDefinition(def))
+	if assert.Len(t, def.repositories, 1) {
+		assert.Equal(t, "Repo", def.repositories[0].Name)
+	}
+
+	assert.Equal(t, defaultGitFullEvery, def.FullEvery)
+
+	assert.NotNil(t, analyzeGitDefinition(&GitDefinition{Name: "Repo", Path: path.Join(dir, "a.git"), FullEvery: 7}),
+		"full_every without incremental")
+	assert.NotNil(t, analyzeGitDefinition(&GitDefinition{Name: "Repo", Path: path.Join(dir, "a.git"), Incremental: true, FullEvery: -1}))
+	assert.NotNil(t, analyzeGitDefinition(&GitDefinition{Name: "Repos"}))
+	assert.NotNil(t, analyzeGitDefinition(&GitDefinition{Name: "Repos", Path: path.Join(dir, "*.svn")}))
+	assert.NotNil(t, analyzeGitDefinition(&GitDefinition{Name: "Repos", Path: path.Join(dir, "plain")}))
+	assert.NotNil(t, analyzeGitDefinition(&GitDefinition{Name: "Repos", Paths: []string{path.Join(dir, "a.git"), path.Join(dir, "*.git")}}),
+		"repositories with the same name")
+}
+
+func TestGenerateGitArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := path.Join(dir, "repo.git")
+	_, err = git(dir, "init", "-q", "--bare", remote)
+	assert.Nil(t, err)
+
+	def := &GitDefinition{
+		Name:                  "Repo",
+		Path:                  remote,
+		Incremental:           true,
+		FullEvery:             3,
+		CompressionDefinition: &CompressionDefinition{Command: "gzip", Extension: "gz"},
+	}
+	assert.Nil(t, analyzeGitDefinition(def))
+	repo := def.repositories[0]
+
+	output := path.Join(dir, "output")
+	assert.Nil(t, os.Mkdir(output, 0755))
+
+	backup := &Backup{StorageDefinitions: []*StorageDefinition{{Name: "Local"}}}
+
+	generate := func(timestamp int) *Artifact {
+		runner := &BackupRunner{Backup: backup, Time: time.Date(2019, 12, timestamp, 12, 0, 0, 0, time.UTC)}
+		artifact := &Artifact{}
+		assert.Nil(t, runner.GenerateGitArtifact(def, repo, FileOutput(output), artifact))
+		runner.SaveBundledRefs()
+		return artifact
+	}
+
+	assert.Empty(t, generate(1).Name, "empty repositories are skipped")
+
+	first := commitTo(t, remote, "first")
+	artifact := generate(2)
+	assert.Equal(t, "repo-20191202120000.bundle.gz", artifact.Name)
+	header := bundleHeader(t, path.Join(output, artifact.Name))
+	assert.Contains(t, header, first+" refs/heads/master")
+	assert.NotContains(t, header, "\n-", "the first bundle is a full one")
+
+	assert.Empty(t, generate(3).Name, "unchanged repositories are skipped")
+
+	second := commitTo(t, remote, "second")
+	artifact = generate(4)
+	assert.Equal(t, "repo-20191204120000.incremental-bundle.gz", artifact.Name)
+	header = bundleHeader(t, path.Join(output, artifact.Name))
+	assert.Contains(t, header, second+" refs/heads/master")
+	assert.Contains(t, header, "\n-"+first, "only the new commit is bundled")
+
+	// Refs of a failed run are not saved
+	third := commitTo(t, remote, "third")
+	runner := &BackupRunner{Backup: backup, Time: time.Date(2019, 12, 5, 12, 0, 0, 0, time.UTC)}
+	assert.Nil(t, runner.GenerateGitArtifact(def, repo, FileOutput(output), &Artifact{}))
+
+	artifact = generate(6)
+	header = bundleHeader(t, path.Join(output, artifact.Name))
+	assert.Contains(t, header, third+" refs/heads/master")
+	assert.Contains(t, header, "\n-"+second)
+
+	// The third incremental bundle in a row is followed by a full one
+	commitTo(t, remote, "fourth")
+	assert.True(t, isIncrementalArtifact(generate(7).Name))
+	commitTo(t, remote, "fifth")
+	artifact = generate(8)
+	assert.Equal(t, "repo-20191208120000.bundle.gz", artifact.Name)
+	assert.NotContains(t, bundleHeader(t, path.Join(output, artifact.Name)), "\n-")
+
+	commitTo(t, remote, "sixth")
+	assert.True(t, isIncrementalArtifact(generate(9).Name))
+
+	// A new storage lacks the earlier bundles, so it gets a full one
+	backup.StorageDefinitions = append(backup.StorageDefinitions, &StorageDefinition{Name: "Remote"})
+	commitTo(t, remote, "seventh")
+	assert.False(t, isIncrementalArtifact(generate(10).Name))
+
+	// Lost refs, e.g. after a force push and gc, lead to a full bundle
+	chain := "refs: ['" + strings.Repeat("1", 40) + "']\nstorages: [Local, Remote]\n"
+	assert.Nil(t, ioutil.WriteFile(def.bundledRefsFile(repo), []byte(chain), 0644))
+	commitTo(t, remote, "eighth")
+	artifact = generate(11)
+	assert.NotContains(t, bundleHeader(t, path.Join(output, artifact.Name)), "\n-")
+}
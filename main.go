@@ -3,17 +3,22 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
 
-func RunCmd(file string) error {
+func RunCmd(file string, tempDir string) error {
 	backup, err := ParseBackupFile(file)
 	if err != nil {
 		return errors.Wrapf(err, "failed reading backup definition '%s'", file)
 	}
 
+	if len(tempDir) > 0 {
+		backup.Backup.TempDir = tempDir
+	}
+
 	err = AnalyzeBackupDefinition(backup)
 	if err != nil {
 		return errors.Wrap(err, "failed analyzing backup")
@@ -32,6 +37,54 @@ func RunCmd(file string) error {
 	return nil
 }
 
+func PruneCmd(file string) error {
+	backup, err := ParseBackupFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading backup definition '%s'", file)
+	}
+
+	err = AnalyzeStorageDefinitions(backup)
+	if err != nil {
+		return errors.Wrap(err, "failed analyzing storages")
+	}
+
+	err = PruneBackup(&backup.Backup, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "failed pruning backup")
+	}
+
+	return nil
+}
+
+func ReplicateCmd(file string, sourceName string, targetName string) error {
+	backup, err := ParseBackupFile(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed reading backup definition '%s'", file)
+	}
+
+	err = AnalyzeStorageDefinitions(backup)
+	if err != nil {
+		return errors.Wrap(err, "failed analyzing storages")
+	}
+
+	source, err := FindStorage(&backup.Backup, sourceName)
+	if err != nil {
+		return errors.Wrap(err, "invalid source")
+	}
+
+	target, err := FindStorage(&backup.Backup, targetName)
+	if err != nil {
+		return errors.Wrap(err, "invalid target")
+	}
+
+	err = Replicate(&backup.Backup, source, target)
+	if err != nil {
+		return errors.Wrap(err, "failed replicating artifacts")
+	}
+
+	return nil
+}
+
 type Options struct {
 	DryRun  bool
 	Verbose bool
@@ -44,6 +97,16 @@ func GetOptions() Options {
 }
 
 func main() {
+	const dryUsage = "do not touch anything, only simulate"
+
+	// --dry is accepted both before and after the command. The command flag
+	// has no destination of its own, as applying it would reset the global
+	// one.
+	dryFlag := &cli.BoolFlag{
+		Name:  "dry",
+		Usage: dryUsage,
+	}
+
 	app := &cli.App{
 		Name:    "rika",
 		Version: "v0.0.1",
@@ -61,6 +124,11 @@ func main() {
 				Usage:       "increase verbosity",
 				Destination: &options.Verbose,
 			},
+			&cli.BoolFlag{
+				Name:        "dry",
+				Usage:       dryUsage,
+				Destination: &options.DryRun,
+			},
 		},
 		Commands: []*cli.Command{
 			{
@@ -68,10 +136,10 @@ func main() {
 				Usage:     "runs a backup from a given YAML file",
 				ArgsUsage: "[FILE]",
 				Flags: []cli.Flag{
-					&cli.BoolFlag{
-						Name:        "dry",
-						Usage:       "do not touch anything, only simulate",
-						Destination: &options.DryRun,
+					dryFlag,
+					&cli.StringFlag{
+						Name:  "temp-dir",
+						Usage: "write artifacts to `DIR` before storing them, overrides temp_dir",
 					},
 				},
 				Action: func(c *cli.Context) error {
@@ -83,8 +151,59 @@ func main() {
 						SetVerbose()
 					}
 
+					if c.Bool("dry") {
+						options.DryRun = true
+					}
+
 					file := c.Args().Get(0)
-					return RunCmd(file)
+					return RunCmd(file, c.String("temp-dir"))
+				},
+			},
+			{
+				Name:      "prune",
+				Usage:     "deletes expired artifacts according to the retention policies of a given YAML file",
+				ArgsUsage: "[FILE]",
+				Flags: []cli.Flag{
+					dryFlag,
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() == 0 {
+						return errors.New("prune: expected filename")
+					}
+
+					if options.Verbose {
+						SetVerbose()
+					}
+
+					if c.Bool("dry") {
+						options.DryRun = true
+					}
+
+					file := c.Args().Get(0)
+					return PruneCmd(file)
+				},
+			},
+			{
+				Name:      "replicate",
+				Usage:     "copies artifacts missing on one storage from another storage of a given YAML file",
+				ArgsUsage: "[FILE] [SOURCE] [TARGET]",
+				Flags: []cli.Flag{
+					dryFlag,
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() < 3 {
+						return errors.New("replicate: expected filename, source and target storage")
+					}
+
+					if options.Verbose {
+						SetVerbose()
+					}
+
+					if c.Bool("dry") {
+						options.DryRun = true
+					}
+
+					return ReplicateCmd(c.Args().Get(0), c.Args().Get(1), c.Args().Get(2))
 				},
 			},
 		},
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FindStorage returns the storage of backup with the given name.
+func FindStorage(backup *Backup, name string) (*StorageDefinition, error) {
+	for _, storage := range backup.StorageDefinitions {
+		if storage.Name == name {
+			return storage, nil
+		}
+	}
+
+	return nil, errors.Errorf("no storage named '%s'", name)
+}
+
+// MissingArtifacts returns the artifacts on source which target does not have.
+// Files not created by rika are ignored.
+func MissingArtifacts(source, target *StorageDefinition) ([]StoredArtifact, error) {
+	sourceArtifacts, err := source.Storage.List()
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s failed", source.Name)
+	}
+
+	targetArtifacts, err := target.Storage.List()
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s failed", target.Name)
+	}
+
+	existing := make(map[string]bool)
+	for _, artifact := range targetArtifacts {
+		existing[artifact.Name] = true
+	}
+
+	var missing []StoredArtifact
+	for _, artifact := range sourceArtifacts {
+		if _, _, ok := ParseArtifactName(artifact.Name); !ok || existing[artifact.Name] {
+			continue
+		}
+
+		missing = append(missing, artifact)
+	}
+
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].Name < missing[j].Name
+	})
+
+	return missing, nil
+}
+
+// replicateArtifact downloads artifact from source into tempDir, stores it on
+// target and verifies the stored copy against the checksum of the download.
+// Unlike regular uploads the copy is always read back, whatever the target's
+// verify mode, as nothing else vouches for it.
+func replicateArtifact(source, target *StorageDefinition, artifact StoredArtifact, tempDir string) error {
+	fullPath := path.Join(tempDir, artifact.Name)
+	defer os.Remove(fullPath)
+
+	err := FetchArtifact(source.Storage, artifact.Name, fullPath)
+	if err != nil {
+		return err
+	}
+
+	size, sum, err := hashFile(fullPath)
+	if err != nil {
+		return err
+	}
+
+	// Some rclone backends cannot tell the size and report -1
+	if artifact.Size >= 0 && size != artifact.Size {
+		return errors.Errorf("fetching %s failed: got %d bytes, expected %d", artifact.Name, size, artifact.Size)
+	}
+
+	_, err = target.RetryDefinition.Do(target.Name+": storing "+artifact.Name, func() error {
+		return target.StoreFile(fullPath)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed storing %s", artifact.Name)
+	}
+
+	return verifyArtifact(target, Artifact{Name: artifact.Name, Size: size, SHA256: sum}, VerifyChecksum)
+}
+
+// Replicate copies the artifacts missing on target from source, without
+// running any dumps. Failing artifacts do not keep the others from being
+// copied. In dry mode the missing artifacts are only listed.
+func Replicate(backup *Backup, source, target *StorageDefinition) error {
+	defer CloseStorages([]*StorageDefinition{source, target})
+
+	if source == target {
+		return errors.New("source and target are the same storage")
+	}
+
+	missing, err := MissingArtifacts(source, target)
+	if err != nil {
+		return err
+	}
+
+	if len(missing) == 0 {
+		log.Printf("%s has all artifacts of %s", target.Name, source.Name)
+		return nil
+	}
+
+	if GetOptions().DryRun {
+		for _, artifact := range missing {
+			log.Printf("%s: would copy %s from %s", target.Name, artifact.Name, source.Name)
+		}
+
+		return nil
+	}
+
+	tempDir, err := ioutil.TempDir(backup.TempDir, "rika")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	var failed []string
+
+	for _, artifact := range missing {
+		log.Printf("%s: copying %s from %s", target.Name, artifact.Name, source.Name)
+
+		err := replicateArtifact(source, target, artifact, tempDir)
+		if err != nil {
+			log.Printf("%s: copying %s failed: %s", target.Name, artifact.Name, err)
+			failed = append(failed, artifact.Name)
+		}
+	}
+
+	log.Printf("%s: copied %d of %d missing artifacts", target.Name, len(missing)-len(failed), len(missing))
+
+	if len(failed) > 0 {
+		return errors.Errorf("copying failed for %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
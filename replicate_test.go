@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backup := &Backup{
+		StorageDefinitions: []*StorageDefinition{
+			{Name: "source", LocalStorageDefinition: &LocalStorageDefinition{Path: path.Join(dir, "source")}},
+			{Name: "target", LocalStorageDefinition: &LocalStorageDefinition{Path: path.Join(dir, "target")}},
+		},
+	}
+	for _, storage := range backup.StorageDefinitions {
+		assert.Nil(t, analyzeStorageDefinition(storage))
+	}
+
+	source, err := FindStorage(backup, "source")
+	assert.Nil(t, err)
+	target, err := FindStorage(backup, "target")
+	assert.Nil(t, err)
+	_, err = FindStorage(backup, "offsite")
+	assert.NotNil(t, err)
+
+	for _, name := range []string{"db-20191201120000.sql.xz", "db-20191202120000.sql.xz", "notes.txt"} {
+		assert.Nil(t, ioutil.WriteFile(path.Join(source.LocalStorageDefinition.Path, name), []byte("contents of "+name), 0644))
+	}
+	assert.Nil(t, ioutil.WriteFile(path.Join(target.LocalStorageDefinition.Path, "db-20191201120000.sql.xz"), []byte("already there"), 0644))
+
+	missing, err := MissingArtifacts(source, target)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db-20191202120000.sql.xz"}, names(missing))
+
+	options.DryRun = true
+	assert.Nil(t, Replicate(backup, source, target))
+	options.DryRun = false
+
+	missing, err = MissingArtifacts(source, target)
+	assert.Nil(t, err)
+	assert.Len(t, missing, 1, "dry run must not copy anything")
+
+	assert.Nil(t, Replicate(backup, source, target))
+
+	contents, err := ioutil.ReadFile(path.Join(target.LocalStorageDefinition.Path, "db-20191202120000.sql.xz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "contents of db-20191202120000.sql.xz", string(contents))
+
+	contents, err = ioutil.ReadFile(path.Join(target.LocalStorageDefinition.Path, "db-20191201120000.sql.xz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "already there", string(contents), "existing artifacts are left alone")
+
+	_, err = os.Stat(path.Join(target.LocalStorageDefinition.Path, "notes.txt"))
+	assert.True(t, os.IsNotExist(err), "files not created by rika are not copied")
+
+	assert.NotNil(t, Replicate(backup, source, source))
+}
+
+// corruptingStorage stores artifacts with their first byte flipped.
+type corruptingStorage struct {
+	*LocalStorageDefinition
+}
+
+func (s *corruptingStorage) Store(artifact string, r io.Reader, size int64) error {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if len(contents) > 0 {
+		contents[0] ^= 0xff
+	}
+
+	return s.LocalStorageDefinition.Store(artifact, bytes.NewReader(contents), size)
+}
+
+func TestReplicateVerifiesChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-replicate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := &StorageDefinition{Name: "source", LocalStorageDefinition: &LocalStorageDefinition{Path: path.Join(dir, "source")}}
+	target := &StorageDefinition{Name: "target", Verify: VerifyNone, LocalStorageDefinition: &LocalStorageDefinition{Path: path.Join(dir, "target")}}
+	backup := &Backup{StorageDefinitions: []*StorageDefinition{source, target}}
+
+	for _, storage := range backup.StorageDefinitions {
+		assert.Nil(t, analyzeStorageDefinition(storage))
+	}
+	target.Storage = &corruptingStorage{target.LocalStorageDefinition}
+
+	assert.Nil(t, ioutil.WriteFile(path.Join(source.LocalStorageDefinition.Path, "db-20191201120000.sql.xz"), []byte("dump"), 0644))
+
+	err = Replicate(backup, source, target)
+	if assert.NotNil(t, err, "a corrupt copy of the same size must fail even with verify: none") {
+		assert.Contains(t, err.Error(), "db-20191201120000.sql.xz")
+	}
+}
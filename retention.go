@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetentionDefinition decides which artifacts of a storage are kept. Every
+// keep_* rule selects the newest artifact of each of the last N days, weeks,
+// etc. that have one, similar to restic or borg. Artifacts selected by no rule
+// or older than MaxAge are deleted. The newest artifact of every backup is
+// always kept, so a failing backup can never prune everything. Neither are
+// the artifacts kept incremental ones build on.
+type RetentionDefinition struct {
+	KeepLast    int    `yaml:"keep_last"`
+	KeepDaily   int    `yaml:"keep_daily"`
+	KeepWeekly  int    `yaml:"keep_weekly"`
+	KeepMonthly int    `yaml:"keep_monthly"`
+	KeepYearly  int    `yaml:"keep_yearly"`
+	MaxAge      string `yaml:"max_age"`
+
+	maxAge time.Duration
+}
+
+// parseAge parses a duration which in addition to time.ParseDuration
+// accepts days and weeks, e.g. "30d" or "12w".
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil {
+			return 0, errors.Errorf("invalid duration '%s'", s)
+		}
+
+		return time.Duration(n) * unit, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+func analyzeRetentionDefinition(def *RetentionDefinition) error {
+	if def.KeepLast < 0 || def.KeepDaily < 0 || def.KeepWeekly < 0 || def.KeepMonthly < 0 || def.KeepYearly < 0 {
+		return errors.New("keep rules must not be negative")
+	}
+
+	if len(def.MaxAge) > 0 {
+		maxAge, err := parseAge(def.MaxAge)
+		if err != nil {
+			return errors.Wrap(err, "invalid max_age")
+		}
+
+		if maxAge <= 0 {
+			return errors.New("max_age must be positive")
+		}
+
+		def.maxAge = maxAge
+	}
+
+	if !def.hasKeepRules() && def.maxAge == 0 {
+		return errors.New("retention needs at least one keep rule or max_age")
+	}
+
+	return nil
+}
+
+func (def *RetentionDefinition) hasKeepRules() bool {
+	return def.KeepLast > 0 || def.KeepDaily > 0 || def.KeepWeekly > 0 || def.KeepMonthly > 0 || def.KeepYearly > 0
+}
+
+var artifactNameRegexp = regexp.MustCompile(`^(.+)-(\d{14})\.([^.]+)\.[^.]+$`)
+
+// IncrementalFileTypePrefix marks the file type of artifacts which only
+// contain changes since the previous artifact of the same name. Restoring one
+// needs all artifacts back to the last one without the prefix.
+const IncrementalFileTypePrefix = "incremental-"
+
+// isIncrementalArtifact reports whether artifact builds on the previous ones.
+func isIncrementalArtifact(artifact string) bool {
+	match := artifactNameRegexp.FindStringSubmatch(artifact)
+	return match != nil && strings.HasPrefix(match[3], IncrementalFileTypePrefix)
+}
+
+// ParseArtifactName splits an artifact name as produced by
+// ConstructArtifactName into the backup name and its timestamp.
+func ParseArtifactName(artifact string) (string, time.Time, bool) {
+	match := artifactNameRegexp.FindStringSubmatch(artifact)
+	if match == nil {
+		return "", time.Time{}, false
+	}
+
+	timestamp, err := time.ParseInLocation("20060102150405", match[2], time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+
+	return match[1], timestamp, true
+}
+
+type datedArtifact struct {
+	StoredArtifact
+	Time time.Time
+}
+
+// Expired returns the artifacts which are not retained by the policy.
+// Artifacts whose names were not produced by rika are never expired.
+func (def *RetentionDefinition) Expired(artifacts []StoredArtifact, now time.Time) []StoredArtifact {
+	groups := make(map[string][]datedArtifact)
+
+	for _, artifact := range artifacts {
+		name, timestamp, ok := ParseArtifactName(artifact.Name)
+		if !ok {
+			continue
+		}
+
+		groups[name] = append(groups[name], datedArtifact{artifact, timestamp})
+	}
+
+	var expired []StoredArtifact
+
+	for _, group := range groups {
+		// Newest first
+		sort.Slice(group, func(i, j int) bool {
+			return group[i].Time.After(group[j].Time)
+		})
+
+		keep := def.selectKept(group)
+		keep[0] = true
+
+		// Whether a newer artifact that is kept builds on this one
+		needed := false
+
+		for i, artifact := range group {
+			tooOld := def.maxAge > 0 && now.Sub(artifact.Time) > def.maxAge
+			kept := i == 0 || (keep[i] && !tooOld) || needed
+
+			if !kept {
+				expired = append(expired, artifact.StoredArtifact)
+			}
+
+			if isIncrementalArtifact(artifact.Name) {
+				needed = needed || kept
+			} else {
+				needed = false
+			}
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Name < expired[j].Name
+	})
+
+	return expired
+}
+
+// selectKept marks the artifacts of a group sorted newest first which are
+// selected by the keep rules.
+func (def *RetentionDefinition) selectKept(group []datedArtifact) []bool {
+	keep := make([]bool, len(group))
+
+	if !def.hasKeepRules() {
+		for i := range keep {
+			keep[i] = true
+		}
+
+		return keep
+	}
+
+	for i := 0; i < def.KeepLast && i < len(group); i++ {
+		keep[i] = true
+	}
+
+	buckets := []struct {
+		count  int
+		bucket func(t time.Time) string
+	}{
+		{def.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{def.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{def.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{def.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+
+	for _, rule := range buckets {
+		last := ""
+		count := 0
+
+		for i := 0; i < len(group) && count < rule.count; i++ {
+			bucket := rule.bucket(group[i].Time)
+			if bucket == last {
+				continue
+			}
+
+			keep[i] = true
+			last = bucket
+			count++
+		}
+	}
+
+	return keep
+}
+
+// ApplyRetention deletes the artifacts on storage which are expired by its
+// retention policy and returns them, along with stale partial uploads left by
+// interrupted runs. In dry mode they are only listed.
+func ApplyRetention(def *StorageDefinition, now time.Time) ([]StoredArtifact, error) {
+	if def.RetentionDefinition == nil {
+		return nil, nil
+	}
+
+	artifacts, err := def.Storage.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing artifacts failed")
+	}
+
+	expired := def.RetentionDefinition.Expired(artifacts, now)
+
+	for _, artifact := range expired {
+		if GetOptions().DryRun {
+			log.Printf("%s: would delete %s", def.Name, artifact.Name)
+			continue
+		}
+
+		log.Printf("%s: deleting expired %s", def.Name, artifact.Name)
+
+		err := def.Storage.Delete(artifact.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = cleanStalePartials(def, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
+
+// cleanStalePartials deletes partial uploads older than StalePartialAge.
+// Younger ones may still be written by a concurrent run.
+func cleanStalePartials(def *StorageDefinition, now time.Time) error {
+	lister, ok := def.Storage.(PartialLister)
+	if !ok {
+		return nil
+	}
+
+	partials, err := lister.ListPartials()
+	if err != nil {
+		return errors.Wrap(err, "listing partial uploads failed")
+	}
+
+	for _, partial := range partials {
+		if now.Sub(partial.ModTime) < StalePartialAge {
+			continue
+		}
+
+		if GetOptions().DryRun {
+			log.Printf("%s: would delete stale partial upload %s", def.Name, partial.Name)
+			continue
+		}
+
+		log.Printf("%s: deleting stale partial upload %s", def.Name, partial.Name)
+
+		err := def.Storage.Delete(partial.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PruneBackup applies the retention policies of all storages of a backup.
+// Failing storages do not keep the others from being pruned.
+func PruneBackup(backup *Backup, now time.Time) error {
+	defer CloseStorages(backup.StorageDefinitions)
+
+	var failed []string
+	pruned := 0
+
+	for _, storage := range backup.StorageDefinitions {
+		if storage.RetentionDefinition == nil {
+			logVerbosef("%s: no retention policy, skipping", storage.Name)
+			continue
+		}
+
+		pruned++
+
+		expired, err := ApplyRetention(storage, now)
+		if err != nil {
+			log.Printf("%s: pruning failed: %s", storage.Name, err)
+			failed = append(failed, storage.Name)
+			continue
+		}
+
+		logVerbosef("%s: %d expired artifacts", storage.Name, len(expired))
+	}
+
+	if pruned == 0 {
+		return errors.New("no storage has a retention policy")
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("pruning failed for %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func artifactsAt(name string, times ...time.Time) []StoredArtifact {
+	var artifacts []StoredArtifact
+	for _, t := range times {
+		artifacts = append(artifacts, StoredArtifact{
+			Name: name + "-" + t.Format("20060102150405") + ".sql.xz",
+		})
+	}
+	return artifacts
+}
+
+func names(artifacts []StoredArtifact) []string {
+	var result []string
+	for _, artifact := range artifacts {
+		result = append(result, artifact.Name)
+	}
+	return result
+}
+
+func TestParseArtifactName(t *testing.T) {
+	name, timestamp, ok := ParseArtifactName("wordpress-database-20191201133700.sql.gz")
+	assert.True(t, ok)
+	assert.Equal(t, "wordpress-database", name)
+	assert.Equal(t, time.Date(2019, 12, 1, 13, 37, 0, 0, time.Local), timestamp)
+
+	_, _, ok = ParseArtifactName("notes.txt")
+	assert.False(t, ok)
+
+	_, _, ok = ParseArtifactName("wordpress-database-20191301133700.sql.gz")
+	assert.False(t, ok, "invalid month")
+}
+
+func TestRetentionKeepLastAndDaily(t *testing.T) {
+	day := func(d, h int) time.Time { return time.Date(2019, 12, d, h, 0, 0, 0, time.Local) }
+	now := day(10, 12)
+
+	artifacts := artifactsAt("db", day(10, 6), day(10, 0), day(9, 18), day(9, 6), day(8, 6), day(7, 6), day(1, 6))
+	artifacts = append(artifacts, StoredArtifact{Name: "README"})
+
+	def := &RetentionDefinition{KeepLast: 2, KeepDaily: 3}
+	assert.Nil(t, analyzeRetentionDefinition(def))
+
+	// Last two are 10th 06:00 and 10th 00:00, dailies are the 10th, 9th and
+	// 8th (newest of each day)
+	assert.Equal(t, []string{
+		"db-20191201060000.sql.xz",
+		"db-20191207060000.sql.xz",
+		"db-20191209060000.sql.xz",
+	}, names(def.Expired(artifacts, now)))
+}
+
+func TestRetentionWeeklyMonthlyYearly(t *testing.T) {
+	var times []time.Time
+	start := time.Date(2018, 1, 1, 3, 0, 0, 0, time.Local)
+	for d := 0; d < 800; d++ {
+		times = append(times, start.AddDate(0, 0, d))
+	}
+	now := times[len(times)-1]
+
+	def := &RetentionDefinition{KeepWeekly: 4, KeepMonthly: 6, KeepYearly: 3}
+	assert.Nil(t, analyzeRetentionDefinition(def))
+
+	expired := def.Expired(artifactsAt("db", times...), now)
+	// 4 weekly + 6 monthly + 3 yearly, minus overlaps: the newest artifact is
+	// picked by all three rules and the last one of 2019 by both the monthly
+	// and the yearly rule
+	assert.Equal(t, 800-(4+6+3-2-1), len(expired))
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	now := time.Date(2019, 12, 31, 12, 0, 0, 0, time.Local)
+
+	def := &RetentionDefinition{MaxAge: "7d"}
+	assert.Nil(t, analyzeRetentionDefinition(def))
+
+	artifacts := artifactsAt("db", now.AddDate(0, 0, -1), now.AddDate(0, 0, -6), now.AddDate(0, 0, -8))
+	assert.Equal(t, names(artifactsAt("db", now.AddDate(0, 0, -8))), names(def.Expired(artifacts, now)))
+
+	// The newest artifact of a backup survives even if it is too old
+	artifacts = artifactsAt("db", now.AddDate(0, 0, -20), now.AddDate(0, 0, -30))
+	assert.Equal(t, names(artifactsAt("db", now.AddDate(0, 0, -30))), names(def.Expired(artifacts, now)))
+
+	// Keep rules do not rescue artifacts older than max_age
+	def = &RetentionDefinition{KeepLast: 10, MaxAge: "48h"}
+	assert.Nil(t, analyzeRetentionDefinition(def))
+
+	artifacts = artifactsAt("db", now.AddDate(0, 0, -1), now.AddDate(0, 0, -3))
+	assert.Equal(t, names(artifactsAt("db", now.AddDate(0, 0, -3))), names(def.Expired(artifacts, now)))
+}
+
+func TestRetentionGroupsByName(t *testing.T) {
+	now := time.Date(2019, 12, 31, 12, 0, 0, 0, time.Local)
+
+	def := &RetentionDefinition{KeepLast: 1}
+	assert.Nil(t, analyzeRetentionDefinition(def))
+
+	artifacts := append(
+		artifactsAt("db", now, now.Add(-time.Hour)),
+		artifactsAt("uploads", now.Add(-2*time.Hour), now.Add(-3*time.Hour))...,
+	)
+
+	assert.Equal(t, []string{
+		"db-20191231110000.sql.xz",
+		"uploads-20191231090000.sql.xz",
+	}, names(def.Expired(artifacts, now)))
+}
+
+func TestRetentionKeepsChainsOfIncrementals(t *testing.T) {
+	day := func(d int) string { return time.Date(2019, 12, d, 3, 0, 0, 0, time.Local).Format("20060102150405") }
+	now := time.Date(2019, 12, 20, 12, 0, 0, 0, time.Local)
+
+	// A full bundle every five days with incremental ones in between
+	var artifacts []StoredArtifact
+	for d := 1; d <= 20; d++ {
+		fileType := "bundle"
+		if d%5 != 1 {
+			fileType = incrementalBundleType
+		}
+		artifacts = append(artifacts, StoredArtifact{Name: "repo-" + day(d) + "." + fileType + ".gz"})
+	}
+
+	def := &RetentionDefinition{KeepLast: 3, MaxAge: "10d"}
+	assert.Nil(t, analyzeRetentionDefinition(def))
+
+	// The last three are incrementals of the chain starting on the 16th,
+	// which is kept along with the ones in between. Older chains go.
+	expired := names(def.Expired(artifacts, now))
+	assert.Len(t, expired, 15)
+	assert.NotContains(t, expired, "repo-"+day(16)+".bundle.gz")
+	assert.Contains(t, expired, "repo-"+day(15)+"."+incrementalBundleType+".gz")
+
+	// Incrementals kept by age keep their full bundle even past max_age
+	def = &RetentionDefinition{MaxAge: "7d"}
+	assert.Nil(t, analyzeRetentionDefinition(def))
+
+	expired = names(def.Expired(artifacts, now))
+	assert.Len(t, expired, 10, "the chain starting on the 11th is needed by the 14th")
+	assert.NotContains(t, expired, "repo-"+day(11)+".bundle.gz")
+	assert.NotContains(t, expired, "repo-"+day(12)+"."+incrementalBundleType+".gz")
+	assert.Contains(t, expired, "repo-"+day(10)+"."+incrementalBundleType+".gz")
+}
+
+func TestRetentionDefinition(t *testing.T) {
+	assert.NotNil(t, analyzeRetentionDefinition(&RetentionDefinition{}))
+	assert.NotNil(t, analyzeRetentionDefinition(&RetentionDefinition{KeepLast: -1}))
+	assert.NotNil(t, analyzeRetentionDefinition(&RetentionDefinition{MaxAge: "a week"}))
+	assert.Nil(t, analyzeRetentionDefinition(&RetentionDefinition{MaxAge: "2w"}))
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 12, 31, 12, 0, 0, 0, time.Local)
+	for _, artifact := range artifactsAt("db", now, now.Add(-time.Hour), now.Add(-2*time.Hour)) {
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, artifact.Name), nil, 0644))
+	}
+
+	stale := path.Join(dir, "db-20191230120000.sql.xz"+PartialSuffix)
+	fresh := path.Join(dir, "db-20191231120000.sql.xz"+PartialSuffix)
+	for _, partial := range []string{stale, fresh} {
+		assert.Nil(t, ioutil.WriteFile(partial, nil, 0644))
+	}
+	assert.Nil(t, os.Chtimes(stale, now.Add(-StalePartialAge), now.Add(-StalePartialAge)))
+	assert.Nil(t, os.Chtimes(fresh, now.Add(-time.Minute), now.Add(-time.Minute)))
+
+	def := &StorageDefinition{
+		Name:                   "Local",
+		LocalStorageDefinition: &LocalStorageDefinition{Path: dir},
+		RetentionDefinition:    &RetentionDefinition{KeepLast: 2},
+	}
+	assert.Nil(t, analyzeStorageDefinition(def))
+
+	options.DryRun = true
+	expired, err := ApplyRetention(def, now)
+	options.DryRun = false
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"db-20191231100000.sql.xz"}, names(expired))
+
+	remaining, err := def.Storage.List()
+	assert.Nil(t, err)
+	assert.Len(t, remaining, 3, "dry run must not delete anything")
+	assert.FileExists(t, stale)
+
+	_, err = ApplyRetention(def, now)
+	assert.Nil(t, err)
+
+	remaining, err = def.Storage.List()
+	assert.Nil(t, err)
+	assert.Equal(t, names(artifactsAt("db", now.Add(-time.Hour), now)), names(remaining))
+
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err), "stale partial upload should be deleted")
+	assert.FileExists(t, fresh, "recent partial upload may still be in progress")
+}
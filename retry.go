@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRetryAttempts     = 3
+	defaultRetryInitialDelay = 5 * time.Second
+	defaultRetryMaxDelay     = time.Minute
+)
+
+// RetryDefinition repeats failed operations. The delay before the first retry
+// is InitialDelay and doubles after every further failure up to MaxDelay.
+// It can be set on the backup and overridden by every data and storage
+// provider.
+type RetryDefinition struct {
+	Attempts     int    `yaml:"attempts"`
+	InitialDelay string `yaml:"initial_delay"`
+	MaxDelay     string `yaml:"max_delay"`
+
+	initialDelay time.Duration
+	maxDelay     time.Duration
+}
+
+func analyzeRetryDefinition(def *RetryDefinition) error {
+	if def.Attempts < 0 {
+		return errors.New("attempts must not be negative")
+	}
+
+	if def.Attempts == 0 {
+		def.Attempts = defaultRetryAttempts
+	}
+
+	def.initialDelay = defaultRetryInitialDelay
+	if len(def.InitialDelay) > 0 {
+		delay, err := time.ParseDuration(def.InitialDelay)
+		if err != nil {
+			return errors.Wrap(err, "invalid initial_delay")
+		}
+
+		def.initialDelay = delay
+	}
+
+	def.maxDelay = defaultRetryMaxDelay
+	if len(def.MaxDelay) > 0 {
+		delay, err := time.ParseDuration(def.MaxDelay)
+		if err != nil {
+			return errors.Wrap(err, "invalid max_delay")
+		}
+
+		def.maxDelay = delay
+	}
+
+	if def.initialDelay < 0 {
+		return errors.New("initial_delay must not be negative")
+	}
+
+	if def.maxDelay < def.initialDelay {
+		return errors.New("max_delay must not be shorter than initial_delay")
+	}
+
+	return nil
+}
+
+// Do calls fn until it succeeds or all attempts failed and returns the number
+// of attempts made along with the last error. A nil definition makes a single
+// attempt.
+func (def *RetryDefinition) Do(what string, fn func() error) (int, error) {
+	if def == nil {
+		return 1, fn()
+	}
+
+	delay := def.initialDelay
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= def.Attempts {
+			return attempt, err
+		}
+
+		log.Printf("%s failed (attempt %d of %d), retrying in %s: %s", what, attempt, def.Attempts, delay, err)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > def.maxDelay {
+			delay = def.maxDelay
+		}
+	}
+}
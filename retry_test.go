@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryDefinition(t *testing.T) {
+	def := &RetryDefinition{}
+	assert.Nil(t, analyzeRetryDefinition(def))
+	assert.Equal(t, defaultRetryAttempts, def.Attempts)
+	assert.Equal(t, defaultRetryInitialDelay, def.initialDelay)
+	assert.Equal(t, defaultRetryMaxDelay, def.maxDelay)
+
+	assert.NotNil(t, analyzeRetryDefinition(&RetryDefinition{Attempts: -1}))
+	assert.NotNil(t, analyzeRetryDefinition(&RetryDefinition{InitialDelay: "soon"}))
+	assert.NotNil(t, analyzeRetryDefinition(&RetryDefinition{InitialDelay: "1m", MaxDelay: "10s"}))
+}
+
+func TestRetryDo(t *testing.T) {
+	calls := 0
+	failTwice := func() error {
+		calls++
+		if calls <= 2 {
+			return errors.New("network blip")
+		}
+		return nil
+	}
+
+	attempts, err := (*RetryDefinition)(nil).Do("nil", failTwice)
+	assert.NotNil(t, err, "no retry definition means a single attempt")
+	assert.Equal(t, 1, attempts)
+
+	def := &RetryDefinition{Attempts: 3, InitialDelay: "1ms", MaxDelay: "2ms"}
+	assert.Nil(t, analyzeRetryDefinition(def))
+
+	calls = 0
+	attempts, err = def.Do("flaky", failTwice)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+
+	calls = 0
+	def.Attempts = 2
+	attempts, err = def.Do("flaky", failTwice)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestRetryInheritance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	own := &RetryDefinition{Attempts: 5}
+
+	def := &BackupDefinition{
+		Version: VERSION,
+		Backup: Backup{
+			Name:            "test",
+			RetryDefinition: &RetryDefinition{Attempts: 2},
+			DataProviders: DataProviders{
+				VolumeDefinitions: []*VolumeDefinition{{Name: "files", Path: dir}},
+			},
+			StorageDefinitions: []*StorageDefinition{
+				{Name: "inherits", LocalStorageDefinition: &LocalStorageDefinition{Path: dir}},
+				{Name: "own", LocalStorageDefinition: &LocalStorageDefinition{Path: dir}, RetryDefinition: own},
+			},
+		},
+	}
+	assert.Nil(t, AnalyzeBackupDefinition(def))
+
+	assert.Equal(t, def.Backup.RetryDefinition, def.Backup.DataProviders.VolumeDefinitions[0].RetryDefinition)
+	assert.Equal(t, def.Backup.RetryDefinition, def.Backup.StorageDefinitions[0].RetryDefinition)
+	assert.Equal(t, own, def.Backup.StorageDefinitions[1].RetryDefinition)
+	assert.Equal(t, defaultRetryInitialDelay, own.initialDelay)
+}
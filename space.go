@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// tempSpaceMargin is added to the estimate, as artifacts tend to grow.
+const tempSpaceMargin = 1.1
+
+// formatBytes formats a size in binary units, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// dirSize sums up the sizes of all regular files below dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+// previousArtifacts returns the newest artifact of every data provider found
+// on any of the storages, keyed by ArtifactBaseName. Storages which cannot be
+// listed are skipped.
+func previousArtifacts(storages []*StorageDefinition) map[string]datedArtifact {
+	previous := make(map[string]datedArtifact)
+
+	for _, storage := range storages {
+		artifacts, err := storage.Storage.List()
+		if err != nil {
+			logVerbosef("%s: could not list artifacts: %s", storage.Name, err)
+			continue
+		}
+
+		for _, artifact := range artifacts {
+			name, timestamp, ok := ParseArtifactName(artifact.Name)
+			if !ok {
+				continue
+			}
+
+			if newest, ok := previous[name]; !ok || timestamp.After(newest.Time) {
+				previous[name] = datedArtifact{artifact, timestamp}
+			}
+		}
+	}
+
+	return previous
+}
+
+// sqliteCopySpace returns the size of the largest SQLite database of the
+// backup. Each is copied in full to the temporary directory before it is
+// compressed, one at a time.
+func (runner *BackupRunner) sqliteCopySpace() int64 {
+	var largest int64
+
+	for _, db := range runner.Backup.DataProviders.DatabaseDefinitions {
+		if db.SQLiteDefinition == nil {
+			continue
+		}
+
+		info, err := os.Stat(db.SQLiteDefinition.Path)
+		if err != nil {
+			logVerbosef("Could not determine size of %s: %s", db.SQLiteDefinition.Path, err)
+			continue
+		}
+
+		if info.Size() > largest {
+			largest = info.Size()
+		}
+	}
+
+	return largest
+}
+
+// EstimateTempSpace guesses how much space a run takes up in the temporary
+// directory. Each data provider is expected to produce an artifact as large
+// as its previous one. Volumes without one count with their uncompressed
+// size, databases without one cannot be estimated. Git repositories without
+// one, or with incremental bundles, count with the size of their git
+// directory. On top of that comes the copy of the largest SQLite database,
+// which is the only thing needed when streaming.
+func (runner *BackupRunner) EstimateTempSpace() int64 {
+	needed := runner.sqliteCopySpace()
+
+	if runner.Backup.Stream {
+		return int64(float64(needed) * tempSpaceMargin)
+	}
+
+	previous := previousArtifacts(runner.Backup.StorageDefinitions)
+
+	for _, db := range runner.Backup.DataProviders.DatabaseDefinitions {
+		if artifact, ok := previous[ArtifactBaseName(db.Name, db.Format)]; ok {
+			needed += artifact.Size
+		} else {
+			logVerbosef("No previous artifact of %s, its size is unknown", db.Name)
+		}
+	}
+
+	for _, volume := range runner.Backup.DataProviders.VolumeDefinitions {
+		if artifact, ok := previous[ArtifactBaseName(volume.Name, volume.Format)]; ok {
+			needed += artifact.Size
+			continue
+		}
+
+		size, err := dirSize(volume.Path)
+		if err != nil {
+			logVerbosef("Could not determine size of %s: %s", volume.Path, err)
+			continue
+		}
+
+		needed += size
+	}
+
+	for _, def := range runner.Backup.DataProviders.GitDefinitions {
+		for _, repo := range def.repositories {
+			if artifact, ok := previous[ArtifactBaseName(repo.Name, def.Format)]; ok && !def.Incremental {
+				needed += artifact.Size
+				continue
+			}
+
+			// Incremental bundles can be full ones any time
+			size, err := dirSize(repo.GitDir)
+			if err != nil {
+				logVerbosef("Could not determine size of %s: %s", repo.GitDir, err)
+				continue
+			}
+
+			needed += size
+		}
+	}
+
+	return int64(float64(needed) * tempSpaceMargin)
+}
+
+// tempDir is where a run writes its artifacts and SQLite copies.
+func (runner *BackupRunner) tempDir() string {
+	if len(runner.TempPath) > 0 {
+		return runner.TempPath
+	}
+
+	if len(runner.Backup.TempDir) > 0 {
+		return runner.Backup.TempDir
+	}
+
+	return os.TempDir()
+}
+
+// CheckTempSpace fails early if the temporary directory has not enough room
+// for the estimated size of the artifacts, instead of running out of space
+// in the middle of a dump.
+func (runner *BackupRunner) CheckTempSpace() error {
+	dir := runner.tempDir()
+
+	needed := runner.EstimateTempSpace()
+	if needed == 0 {
+		return nil
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		logVerbosef("Could not determine free space in %s, skipping check: %s", dir, err)
+		return nil
+	}
+
+	logVerbosef("%s has %s free, the backup needs an estimated %s", dir, formatBytes(free), formatBytes(needed))
+
+	if needed > free {
+		hint := "set temp_dir or --temp-dir to a larger disk"
+		if !runner.Backup.Stream {
+			hint += ", or use stream: true"
+		}
+
+		return errors.Errorf("not enough space in %s: %s free, but the backup needs an estimated %s; %s",
+			dir, formatBytes(free), formatBytes(needed), hint)
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// listedStorage lists a fixed set of artifacts.
+type listedStorage struct {
+	slowStorage
+	artifacts []StoredArtifact
+}
+
+func (s *listedStorage) List() ([]StoredArtifact, error) {
+	return s.artifacts, nil
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "512 B", formatBytes(512))
+	assert.Equal(t, "1.5 KiB", formatBytes(1536))
+	assert.Equal(t, "10.0 GiB", formatBytes(10<<30))
+}
+
+func TestEstimateTempSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	volume := path.Join(dir, "volume")
+	assert.Nil(t, os.MkdirAll(path.Join(volume, "nested"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(volume, "a"), make([]byte, 600), 0644))
+	assert.Nil(t, ioutil.WriteFile(path.Join(volume, "nested", "b"), make([]byte, 400), 0644))
+
+	storage := &listedStorage{artifacts: []StoredArtifact{
+		{Name: "my-database-20191201120000.sql.xz", Size: 3000},
+		{Name: "my-database-20191202120000.sql.xz", Size: 5000},
+		{Name: "my-database-20191130120000.sql.xz", Size: 9000},
+		{Name: "notes.txt", Size: 1 << 40},
+	}}
+
+	runner := &BackupRunner{
+		TempPath: dir,
+		Time:     time.Now(),
+		Backup: &Backup{
+			DataProviders: DataProviders{
+				DatabaseDefinitions: []*DatabaseDefinition{{Name: "My Database"}, {Name: "New Database"}},
+				VolumeDefinitions:   []*VolumeDefinition{{Name: "Files", Path: volume}},
+			},
+			StorageDefinitions: []*StorageDefinition{{Name: "listed", Storage: storage}},
+		},
+	}
+
+	// The newest database artifact and the uncompressed volume, plus margin
+	expected := int64(5000 + 1000)
+	assert.Equal(t, int64(float64(expected)*tempSpaceMargin), runner.EstimateTempSpace())
+	assert.Nil(t, runner.CheckTempSpace())
+
+	storage.artifacts = append(storage.artifacts, StoredArtifact{Name: "files-20191203120000.tar.xz", Size: 1 << 60})
+	err = runner.CheckTempSpace()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "not enough space in "+dir)
+	}
+}
+
+func TestEstimateTempSpaceSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-space")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, size := range map[string]int{"a.db": 2000, "b.db": 3000} {
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, name), make([]byte, size), 0644))
+	}
+
+	storage := &listedStorage{artifacts: []StoredArtifact{
+		{Name: "a-20191201120000.sqlite.xz", Size: 500},
+		{Name: "b-20191201120000.sqlite.xz", Size: 700},
+	}}
+
+	runner := &BackupRunner{
+		TempPath: dir,
+		Time:     time.Now(),
+		Backup: &Backup{
+			DataProviders: DataProviders{
+				DatabaseDefinitions: []*DatabaseDefinition{
+					{Name: "A", SQLiteDefinition: &SQLiteDefinition{Path: path.Join(dir, "a.db")}},
+					{Name: "B", SQLiteDefinition: &SQLiteDefinition{Path: path.Join(dir, "b.db")}},
+				},
+			},
+			StorageDefinitions: []*StorageDefinition{{Name: "listed", Storage: storage}},
+		},
+	}
+
+	// Both artifacts and the copy of the larger database
+	expected := int64(500 + 700 + 3000)
+	assert.Equal(t, int64(float64(expected)*tempSpaceMargin), runner.EstimateTempSpace())
+
+	// Streamed artifacts take no space, but the copies still do
+	runner.TempPath = ""
+	runner.Backup.Stream = true
+	runner.Backup.TempDir = dir
+	expected = 3000
+	assert.Equal(t, int64(float64(expected)*tempSpaceMargin), runner.EstimateTempSpace())
+	assert.Equal(t, dir, runner.tempDir())
+	assert.Nil(t, runner.CheckTempSpace())
+}
+
+func TestTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-temp-dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runner, err := NewBackupRunner(&Backup{TempDir: dir})
+	assert.Nil(t, err)
+	defer os.RemoveAll(runner.TempPath)
+
+	assert.Equal(t, dir, path.Dir(runner.TempPath))
+
+	def := &BackupDefinition{
+		Version: VERSION,
+		Backup: Backup{
+			Name:          "test",
+			TempDir:       path.Join(dir, "missing"),
+			DataProviders: DataProviders{VolumeDefinitions: []*VolumeDefinition{{Name: "files", Path: dir}}},
+		},
+	}
+	assert.NotNil(t, AnalyzeBackupDefinition(def))
+}
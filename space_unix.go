@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system containing dir.
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), nil
+}
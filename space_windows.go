@@ -0,0 +1,7 @@
+package main
+
+import "github.com/pkg/errors"
+
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("not supported on Windows")
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/pkg/errors"
+)
+
+const (
+	mebibyte = 1024 * 1024
+
+	// azureMaxBlocks is the most blocks a block blob can consist of
+	azureMaxBlocks = 50000
+	// azureMaxBlockSize in MiB
+	azureMaxBlockSize = 4000
+	// azureStreamBlockSize is used when the size of an artifact is not known
+	// in advance, which allows for artifacts of up to about 390 GiB
+	azureStreamBlockSize = 8 * mebibyte
+)
+
+type AzureStorageDefinition struct {
+	Format    string `yaml:"format"`
+	Account   string `yaml:"account"`
+	Container string `yaml:"container"`
+	Prefix    string `yaml:"prefix"`
+	SASToken  string `yaml:"sas_token"`
+	SharedKey string `yaml:"shared_key"`
+	// Endpoint overrides the blob service URL, e.g. for the Azurite
+	// emulator: http://127.0.0.1:10000/devstoreaccount1
+	Endpoint string `yaml:"endpoint"`
+	// BlockSize in MiB used for uploading artifacts in blocks. Leave empty
+	// to derive it from the size of each artifact, as a blob can consist of
+	// at most 50,000 blocks.
+	BlockSize int `yaml:"block_size"`
+
+	client *azblob.Client
+}
+
+func analyzeAzureStorageDefinition(def *AzureStorageDefinition) error {
+	if len(def.Account) == 0 {
+		return errors.New("missing account")
+	}
+
+	if len(def.Container) == 0 {
+		return errors.New("missing container")
+	}
+
+	if len(def.SASToken) == 0 && len(def.SharedKey) == 0 {
+		return errors.New("missing sas_token or shared_key")
+	}
+
+	if len(def.SASToken) > 0 && len(def.SharedKey) > 0 {
+		return errors.New("sas_token and shared_key are mutually exclusive")
+	}
+
+	if def.BlockSize < 0 || def.BlockSize > azureMaxBlockSize {
+		return errors.Errorf("block_size must be between 1 and %d MiB, or left empty", azureMaxBlockSize)
+	}
+
+	if len(def.Endpoint) == 0 {
+		def.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", def.Account)
+	}
+
+	serviceURL, err := url.Parse(def.Endpoint)
+	if err != nil {
+		return errors.Wrap(err, "invalid endpoint")
+	}
+
+	def.Prefix = strings.Trim(def.Prefix, "/")
+
+	if len(def.SharedKey) > 0 {
+		cred, err := azblob.NewSharedKeyCredential(def.Account, def.SharedKey)
+		if err != nil {
+			return errors.Wrap(err, "invalid shared_key")
+		}
+
+		def.client, err = azblob.NewClientWithSharedKeyCredential(serviceURL.String(), cred, nil)
+		if err != nil {
+			return errors.Wrap(err, "could not create Azure client")
+		}
+	} else {
+		serviceURL.RawQuery = strings.TrimPrefix(def.SASToken, "?")
+
+		def.client, err = azblob.NewClientWithNoCredential(serviceURL.String(), nil)
+		if err != nil {
+			return errors.Wrap(err, "could not create Azure client")
+		}
+	}
+
+	return nil
+}
+
+func (def *AzureStorageDefinition) blobName(artifact string) string {
+	return path.Join(def.Prefix, artifact)
+}
+
+// blockSize returns the block size in bytes for an artifact of size bytes,
+// or of unknown size if it is negative.
+func (def *AzureStorageDefinition) blockSize(size int64) int64 {
+	if def.BlockSize > 0 {
+		return int64(def.BlockSize) * mebibyte
+	}
+
+	if size < 0 {
+		return azureStreamBlockSize
+	}
+
+	// The smallest whole number of MiB which fits size into the maximum
+	// number of blocks
+	blocks := (size + azureMaxBlocks*mebibyte - 1) / (azureMaxBlocks * mebibyte)
+	if blocks < 1 {
+		blocks = 1
+	}
+
+	return blocks * mebibyte
+}
+
+func (def *AzureStorageDefinition) Store(artifact string, r io.Reader, size int64) error {
+	blobName := def.blobName(artifact)
+
+	logVerbosef("Azure: Uploading %s to %s/%s", artifact, def.Container, blobName)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	blockSize := def.blockSize(size)
+	if size > blockSize*azureMaxBlocks {
+		return errors.Errorf("%s is too large for a block_size of %d MiB", artifact, def.BlockSize)
+	}
+
+	_, err := def.client.UploadStream(context.Background(), def.Container, blobName, r, &azblob.UploadStreamOptions{
+		BlockSize: blockSize,
+	})
+	if err != nil {
+		return errors.Wrapf(err, "uploading %s/%s failed", def.Container, blobName)
+	}
+
+	return nil
+}
+
+func (def *AzureStorageDefinition) listPrefix() string {
+	if len(def.Prefix) == 0 {
+		return ""
+	}
+
+	return def.Prefix + "/"
+}
+
+func (def *AzureStorageDefinition) List() ([]StoredArtifact, error) {
+	prefix := def.listPrefix()
+	pager := def.client.NewListBlobsFlatPager(def.Container, &azblob.ListBlobsFlatOptions{
+		Prefix: &prefix,
+	})
+
+	var artifacts []StoredArtifact
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing %s/%s failed", def.Container, def.Prefix)
+		}
+
+		for _, blob := range page.Segment.BlobItems {
+			name := strings.TrimPrefix(*blob.Name, prefix)
+
+			// Flat listings include blobs in nested "directories"
+			if strings.Contains(name, "/") {
+				continue
+			}
+
+			artifact := StoredArtifact{Name: name}
+			if blob.Properties != nil {
+				if blob.Properties.ContentLength != nil {
+					artifact.Size = *blob.Properties.ContentLength
+				}
+				if blob.Properties.LastModified != nil {
+					artifact.ModTime = *blob.Properties.LastModified
+				}
+			}
+
+			artifacts = append(artifacts, artifact)
+		}
+	}
+
+	return artifacts, nil
+}
+
+func (def *AzureStorageDefinition) Fetch(artifact string, w io.Writer) error {
+	blobName := def.blobName(artifact)
+
+	resp, err := def.client.DownloadStream(context.Background(), def.Container, blobName, nil)
+	if err != nil {
+		return errors.Wrapf(err, "downloading %s/%s failed", def.Container, blobName)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "downloading %s/%s failed", def.Container, blobName)
+	}
+
+	return nil
+}
+
+func (def *AzureStorageDefinition) Delete(artifact string) error {
+	blobName := def.blobName(artifact)
+
+	logVerbosef("Azure: Deleting %s/%s", def.Container, blobName)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	_, err := def.client.DeleteBlob(context.Background(), def.Container, blobName, nil)
+	if err != nil {
+		return errors.Wrapf(err, "deleting %s/%s failed", def.Container, blobName)
+	}
+
+	return nil
+}
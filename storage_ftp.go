@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+	"github.com/pkg/errors"
+)
+
+const ftpDialTimeout = 30 * time.Second
+
+const (
+	FTPTLSNone     = "none"
+	FTPTLSExplicit = "explicit"
+	FTPTLSImplicit = "implicit"
+)
+
+// FTPStorageDefinition uploads artifacts over FTP or FTPS. Transfers always
+// use passive mode; DisableEPSV falls back from EPSV to plain PASV for servers
+// or NAT gateways that do not handle EPSV.
+type FTPStorageDefinition struct {
+	Format             string `yaml:"format"`
+	Host               string `yaml:"host"`
+	Port               int    `yaml:"port"`
+	User               string `yaml:"user"`
+	Password           string `yaml:"password"`
+	PasswordFile       string `yaml:"password_file"`
+	Path               string `yaml:"path"`
+	TLS                string `yaml:"tls"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	DisableEPSV        bool   `yaml:"disable_epsv"`
+
+	conn *ftp.ServerConn
+}
+
+func analyzeFTPStorageDefinition(def *FTPStorageDefinition) error {
+	if len(def.Host) == 0 {
+		return errors.New("missing host")
+	}
+
+	if len(def.Path) == 0 {
+		return errors.New("missing remote path")
+	}
+
+	if len(def.User) == 0 {
+		def.User = "anonymous"
+	}
+
+	switch def.TLS {
+	case "":
+		def.TLS = FTPTLSNone
+	case FTPTLSNone, FTPTLSExplicit, FTPTLSImplicit:
+	default:
+		return errors.Errorf("invalid tls mode '%s', expected none, explicit or implicit", def.TLS)
+	}
+
+	if def.Port == 0 {
+		if def.TLS == FTPTLSImplicit {
+			def.Port = 990
+		} else {
+			def.Port = 21
+		}
+	}
+
+	if len(def.Password) > 0 && len(def.PasswordFile) > 0 {
+		return errors.New("password and password_file are mutually exclusive")
+	}
+
+	if len(def.PasswordFile) > 0 {
+		password, err := ioutil.ReadFile(def.PasswordFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read password file")
+		}
+
+		def.Password = strings.TrimRight(string(password), "\r\n")
+	}
+
+	return nil
+}
+
+// connect logs in on first use and creates the remote path. The connection
+// is kept open for all artifacts of a run until Close is called.
+func (def *FTPStorageDefinition) connect() error {
+	if def.conn != nil {
+		return nil
+	}
+
+	addr := net.JoinHostPort(def.Host, strconv.Itoa(def.Port))
+
+	options := []ftp.DialOption{
+		ftp.DialWithTimeout(ftpDialTimeout),
+		ftp.DialWithDisabledEPSV(def.DisableEPSV),
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         def.Host,
+		InsecureSkipVerify: def.InsecureSkipVerify,
+	}
+
+	switch def.TLS {
+	case FTPTLSExplicit:
+		options = append(options, ftp.DialWithExplicitTLS(tlsConfig))
+	case FTPTLSImplicit:
+		options = append(options, ftp.DialWithTLS(tlsConfig))
+	}
+
+	logVerbosef("FTP: Connecting to %s@%s (tls: %s)", def.User, addr, def.TLS)
+
+	conn, err := ftp.Dial(addr, options...)
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to %s", addr)
+	}
+
+	err = conn.Login(def.User, def.Password)
+	if err != nil {
+		conn.Quit()
+		return errors.Wrapf(err, "login as %s failed", def.User)
+	}
+
+	err = def.makeDirs(conn)
+	if err != nil {
+		conn.Quit()
+		return err
+	}
+
+	def.conn = conn
+
+	return nil
+}
+
+// makeDirs creates every segment of Path. FTP has no "mkdir -p" and servers
+// disagree on the reply for existing directories, so errors are ignored and
+// the result is checked by changing into the final directory.
+func (def *FTPStorageDefinition) makeDirs(conn *ftp.ServerConn) error {
+	cwd, err := conn.CurrentDir()
+	if err != nil {
+		return errors.Wrap(err, "could not determine working directory")
+	}
+
+	current := ""
+	if strings.HasPrefix(def.Path, "/") {
+		current = "/"
+	}
+
+	for _, segment := range strings.Split(strings.Trim(def.Path, "/"), "/") {
+		current = path.Join(current, segment)
+		conn.MakeDir(current)
+	}
+
+	err = conn.ChangeDir(def.Path)
+	if err != nil {
+		return errors.Wrapf(err, "could not create remote path %s", def.Path)
+	}
+
+	return conn.ChangeDir(cwd)
+}
+
+func (def *FTPStorageDefinition) Close() error {
+	if def.conn == nil {
+		return nil
+	}
+
+	err := def.conn.Quit()
+	def.conn = nil
+
+	return err
+}
+
+func (def *FTPStorageDefinition) remotePath(artifact string) string {
+	return path.Join(def.Path, artifact)
+}
+
+func (def *FTPStorageDefinition) Store(artifact string, r io.Reader, size int64) error {
+	remotePath := def.remotePath(artifact)
+
+	logVerbosef("FTP: Uploading %s to %s:%s", artifact, def.Host, remotePath)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	// Uploading to a partial name first keeps an interrupted or aborted
+	// upload from showing up as a truncated artifact
+	partialPath := remotePath + PartialSuffix
+
+	err = def.conn.Stor(partialPath, r)
+	if err != nil {
+		// The control connection may be gone, the next attempt reconnects
+		def.Close()
+		return errors.Wrapf(err, "uploading %s failed", remotePath)
+	}
+
+	err = def.conn.Rename(partialPath, remotePath)
+	if err != nil {
+		return errors.Wrapf(err, "renaming %s failed", partialPath)
+	}
+
+	return nil
+}
+
+// listFiles returns either the finished artifacts or the partial uploads in
+// Path.
+func (def *FTPStorageDefinition) listFiles(partial bool) ([]StoredArtifact, error) {
+	err := def.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := def.conn.List(def.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s failed", def.Path)
+	}
+
+	var artifacts []StoredArtifact
+	for _, entry := range entries {
+		if entry.Type != ftp.EntryTypeFile || strings.HasSuffix(entry.Name, PartialSuffix) != partial {
+			continue
+		}
+
+		artifacts = append(artifacts, StoredArtifact{
+			Name:    path.Base(entry.Name),
+			Size:    int64(entry.Size),
+			ModTime: entry.Time,
+		})
+	}
+
+	return artifacts, nil
+}
+
+func (def *FTPStorageDefinition) List() ([]StoredArtifact, error) {
+	return def.listFiles(false)
+}
+
+func (def *FTPStorageDefinition) ListPartials() ([]StoredArtifact, error) {
+	return def.listFiles(true)
+}
+
+func (def *FTPStorageDefinition) Fetch(artifact string, w io.Writer) error {
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	remotePath := def.remotePath(artifact)
+
+	resp, err := def.conn.Retr(remotePath)
+	if err != nil {
+		return errors.Wrapf(err, "downloading %s failed", remotePath)
+	}
+
+	_, err = io.Copy(w, resp)
+	if err != nil {
+		resp.Close()
+		return errors.Wrapf(err, "downloading %s failed", remotePath)
+	}
+
+	// Close reads the final reply of the transfer, which reports errors
+	// that happened on the server side
+	err = resp.Close()
+	if err != nil {
+		return errors.Wrapf(err, "downloading %s failed", remotePath)
+	}
+
+	return nil
+}
+
+func (def *FTPStorageDefinition) Delete(artifact string) error {
+	remotePath := def.remotePath(artifact)
+
+	logVerbosef("FTP: Deleting %s:%s", def.Host, remotePath)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	err = def.conn.Delete(remotePath)
+	if err != nil {
+		return errors.Wrapf(err, "deleting %s failed", remotePath)
+	}
+
+	return nil
+}
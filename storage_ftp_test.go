@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFTPServer implements just enough of FTP for uploads, keeping files in
+// memory. The first drops STOR commands close the control connection, like
+// a connection lost in the middle of an upload.
+type fakeFTPServer struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	files map[string][]byte
+	drops int
+	conns int
+}
+
+func newFakeFTPServer(t *testing.T) *fakeFTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeFTPServer{listener: listener, files: make(map[string][]byte)}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			server.mu.Lock()
+			server.conns++
+			server.mu.Unlock()
+
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *fakeFTPServer) Close() {
+	s.listener.Close()
+}
+
+func (s *fakeFTPServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeFTPServer) file(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	contents, ok := s.files[name]
+	return contents, ok
+}
+
+func (s *fakeFTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(format string, a ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", a...)
+	}
+
+	var data net.Listener
+	var renameFrom string
+
+	reply("220 fake")
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		arg := ""
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "USER":
+			reply("331 password please")
+		case "PASS":
+			reply("230 logged in")
+		case "TYPE":
+			reply("200 ok")
+		case "PWD":
+			reply(`257 "/"`)
+		case "MKD":
+			reply(`257 "%s"`, arg)
+		case "CWD":
+			reply("250 ok")
+		case "EPSV":
+			data, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return
+			}
+			reply("229 Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port)
+		case "STOR":
+			s.mu.Lock()
+			drop := s.drops > 0
+			if drop {
+				s.drops--
+			}
+			s.mu.Unlock()
+
+			if drop {
+				data.Close()
+				return
+			}
+
+			reply("150 ok")
+
+			dataConn, err := data.Accept()
+			data.Close()
+			if err != nil {
+				return
+			}
+
+			contents, err := ioutil.ReadAll(dataConn)
+			dataConn.Close()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.files[arg] = contents
+			s.mu.Unlock()
+
+			reply("226 done")
+		case "RNFR":
+			renameFrom = arg
+			reply("350 ready")
+		case "RNTO":
+			s.mu.Lock()
+			contents, ok := s.files[renameFrom]
+			if ok {
+				delete(s.files, renameFrom)
+				s.files[arg] = contents
+			}
+			s.mu.Unlock()
+
+			if ok {
+				reply("250 renamed")
+			} else {
+				reply("550 no such file")
+			}
+		case "DELE":
+			s.mu.Lock()
+			delete(s.files, arg)
+			s.mu.Unlock()
+			reply("250 deleted")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func TestFTPStoreReconnects(t *testing.T) {
+	server := newFakeFTPServer(t)
+	defer server.Close()
+	server.drops = 1
+
+	dir, err := ioutil.TempDir("", "rika-ftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	artifact := path.Join(dir, "db-20191201120000.sql.xz")
+	assert.Nil(t, ioutil.WriteFile(artifact, []byte("dump"), 0644))
+
+	ftpDef := &FTPStorageDefinition{Host: "127.0.0.1", Port: server.Port(), Path: "/backups"}
+	assert.Nil(t, analyzeFTPStorageDefinition(ftpDef))
+	defer ftpDef.Close()
+
+	def := &StorageDefinition{
+		Name:                 "FTP",
+		Storage:              ftpDef,
+		RetryDefinition:      &RetryDefinition{Attempts: 2, InitialDelay: "1ms"},
+		FTPStorageDefinition: ftpDef,
+	}
+	assert.Nil(t, analyzeRetryDefinition(def.RetryDefinition))
+
+	attempts, err := def.RetryDefinition.Do("storing", func() error {
+		return def.StoreFile(artifact)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+	server.mu.Lock()
+	assert.Equal(t, 2, server.conns, "the second attempt uses a new connection")
+	server.mu.Unlock()
+
+	contents, ok := server.file("/backups/db-20191201120000.sql.xz")
+	assert.True(t, ok)
+	assert.Equal(t, "dump", string(contents))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const defaultGCSChunkSize = 16
+
+type GCSStorageDefinition struct {
+	Format string `yaml:"format"`
+	Bucket string `yaml:"bucket"`
+	Prefix string `yaml:"prefix"`
+	// Credentials is the path to a service account JSON key. Without it the
+	// application default credentials are used.
+	Credentials string `yaml:"credentials"`
+	// Endpoint overrides the JSON API endpoint, e.g. for fake-gcs-server:
+	// http://localhost:4443/storage/v1/
+	Endpoint string `yaml:"endpoint"`
+	// Anonymous sends requests without credentials, for emulators which do
+	// not check them.
+	Anonymous bool `yaml:"anonymous"`
+	// ChunkSize in MiB of the resumable upload. Every chunk is retried
+	// individually, so an interrupted request does not restart the upload.
+	ChunkSize int `yaml:"chunk_size"`
+
+	client *storage.Client
+}
+
+func analyzeGCSStorageDefinition(def *GCSStorageDefinition) error {
+	if len(def.Bucket) == 0 {
+		return errors.New("missing bucket")
+	}
+
+	if def.Anonymous && len(def.Credentials) > 0 {
+		return errors.New("anonymous and credentials are mutually exclusive")
+	}
+
+	if len(def.Credentials) > 0 {
+		if _, err := os.Stat(def.Credentials); err != nil {
+			return errors.Wrap(err, "invalid credentials")
+		}
+	}
+
+	if def.ChunkSize < 0 {
+		return errors.New("chunk_size must be positive")
+	}
+
+	if def.ChunkSize == 0 {
+		def.ChunkSize = defaultGCSChunkSize
+	}
+
+	def.Prefix = strings.Trim(def.Prefix, "/")
+
+	return nil
+}
+
+// connect creates the client on first use, as looking up the default
+// credentials may involve talking to the metadata server.
+func (def *GCSStorageDefinition) connect() error {
+	if def.client != nil {
+		return nil
+	}
+
+	var options []option.ClientOption
+
+	if len(def.Credentials) > 0 {
+		options = append(options, option.WithAuthCredentialsFile(option.ServiceAccount, def.Credentials))
+	} else if def.Anonymous {
+		options = append(options, option.WithoutAuthentication())
+	}
+
+	if len(def.Endpoint) > 0 {
+		options = append(options, option.WithEndpoint(def.Endpoint))
+	}
+
+	client, err := storage.NewClient(context.Background(), options...)
+	if err != nil {
+		return errors.Wrap(err, "could not create GCS client")
+	}
+
+	def.client = client
+
+	return nil
+}
+
+func (def *GCSStorageDefinition) Close() error {
+	if def.client == nil {
+		return nil
+	}
+
+	err := def.client.Close()
+	def.client = nil
+
+	return err
+}
+
+func (def *GCSStorageDefinition) objectName(artifact string) string {
+	return path.Join(def.Prefix, artifact)
+}
+
+func (def *GCSStorageDefinition) Store(artifact string, r io.Reader, size int64) error {
+	objectName := def.objectName(artifact)
+
+	logVerbosef("GCS: Uploading %s to gs://%s/%s", artifact, def.Bucket, objectName)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	writer := def.client.Bucket(def.Bucket).Object(objectName).NewWriter(ctx)
+	writer.ChunkSize = def.ChunkSize * 1024 * 1024
+	writer.ContentType = "application/octet-stream"
+
+	_, err = io.Copy(writer, r)
+	if err != nil {
+		// Cancelling the context aborts the upload instead of committing a
+		// truncated object
+		cancel()
+		writer.Close()
+		return errors.Wrapf(err, "uploading to gs://%s/%s failed", def.Bucket, objectName)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return errors.Wrapf(err, "uploading to gs://%s/%s failed", def.Bucket, objectName)
+	}
+
+	return nil
+}
+
+func (def *GCSStorageDefinition) listPrefix() string {
+	if len(def.Prefix) == 0 {
+		return ""
+	}
+
+	return def.Prefix + "/"
+}
+
+func (def *GCSStorageDefinition) List() ([]StoredArtifact, error) {
+	err := def.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := def.client.Bucket(def.Bucket).Objects(context.Background(), &storage.Query{
+		Prefix:    def.listPrefix(),
+		Delimiter: "/",
+	})
+
+	var artifacts []StoredArtifact
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "listing gs://%s/%s failed", def.Bucket, def.Prefix)
+		}
+
+		// Synthetic directory entries have no name
+		if len(attrs.Name) == 0 {
+			continue
+		}
+
+		artifacts = append(artifacts, StoredArtifact{
+			Name:    strings.TrimPrefix(attrs.Name, def.listPrefix()),
+			Size:    attrs.Size,
+			ModTime: attrs.Updated,
+		})
+	}
+
+	return artifacts, nil
+}
+
+func (def *GCSStorageDefinition) Fetch(artifact string, w io.Writer) error {
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	objectName := def.objectName(artifact)
+
+	reader, err := def.client.Bucket(def.Bucket).Object(objectName).NewReader(context.Background())
+	if err != nil {
+		return errors.Wrapf(err, "downloading gs://%s/%s failed", def.Bucket, objectName)
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		return errors.Wrapf(err, "downloading gs://%s/%s failed", def.Bucket, objectName)
+	}
+
+	return nil
+}
+
+func (def *GCSStorageDefinition) Delete(artifact string) error {
+	objectName := def.objectName(artifact)
+
+	logVerbosef("GCS: Deleting gs://%s/%s", def.Bucket, objectName)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	err = def.client.Bucket(def.Bucket).Object(objectName).Delete(context.Background())
+	if err != nil {
+		return errors.Wrapf(err, "deleting gs://%s/%s failed", def.Bucket, objectName)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RcloneStorageDefinition hands artifacts to rclone, which gives access to
+// every backend rclone supports through a single provider.
+type RcloneStorageDefinition struct {
+	Format string `yaml:"format"`
+	Remote string `yaml:"remote"`
+	Path   string `yaml:"path"`
+	Config string `yaml:"config"`
+	Args   string `yaml:"args"`
+
+	program string
+}
+
+func analyzeRcloneStorageDefinition(def *RcloneStorageDefinition) error {
+	def.Remote = strings.TrimSuffix(def.Remote, ":")
+	if len(def.Remote) == 0 {
+		return errors.New("missing remote")
+	}
+
+	if len(def.Config) > 0 {
+		if _, err := os.Stat(def.Config); err != nil {
+			return errors.Wrap(err, "invalid config")
+		}
+	}
+
+	program, err := which("rclone")
+	if err != nil {
+		return errors.Wrap(err, "could not find rclone executable")
+	}
+
+	def.program = program
+
+	return nil
+}
+
+func (def *RcloneStorageDefinition) remotePath(artifact string) string {
+	return fmt.Sprintf("%s:%s", def.Remote, path.Join(def.Path, artifact))
+}
+
+// command builds an rclone invocation with the configured config file and
+// additional arguments.
+func (def *RcloneStorageDefinition) command(args ...string) *exec.Cmd {
+	var fullArgs []string
+
+	if len(def.Config) > 0 {
+		fullArgs = append(fullArgs, "--config", def.Config)
+	}
+
+	fullArgs = append(fullArgs, strings.Fields(def.Args)...)
+	fullArgs = append(fullArgs, args...)
+
+	return exec.Command(def.program, fullArgs...)
+}
+
+// run executes cmd and includes rclone's own error output in the returned
+// error, as the exit status alone says nothing about what went wrong.
+func (def *RcloneStorageDefinition) run(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+
+	if GetOptions().Verbose {
+		cmd.Stderr = io.MultiWriter(&stderr, os.Stderr)
+	} else {
+		cmd.Stderr = &stderr
+	}
+
+	err := cmd.Run()
+	if err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if len(message) > 0 {
+			return errors.Errorf("rclone failed: %s", message)
+		}
+
+		return errors.Wrap(err, "rclone failed")
+	}
+
+	return nil
+}
+
+func (def *RcloneStorageDefinition) Store(artifact string, r io.Reader, size int64) error {
+	remotePath := def.remotePath(artifact)
+
+	// rcat uploads from stdin so bandwidth limits apply. Without a size,
+	// rclone spools artifacts above its streaming cutoff to a temporary file
+	// for backends which cannot stream, so it is passed when known.
+	args := []string{"rcat"}
+	if size >= 0 {
+		args = append(args, "--size", strconv.FormatInt(size, 10))
+	}
+
+	// rcat commits whatever it has read once stdin is closed, even if the
+	// artifact was aborted. Uploading to a partial name first keeps it from
+	// showing up as a truncated artifact.
+	partialPath := remotePath + PartialSuffix
+
+	cmd := def.command(append(args, partialPath)...)
+	cmd.Stdin = r
+	logVerbose(cmd)
+
+	moveCmd := def.command("moveto", partialPath, remotePath)
+	logVerbose(moveCmd)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.run(cmd)
+	if err != nil {
+		return errors.Wrapf(err, "uploading to %s failed", remotePath)
+	}
+
+	err = def.run(moveCmd)
+	if err != nil {
+		return errors.Wrapf(err, "renaming %s failed", partialPath)
+	}
+
+	return nil
+}
+
+// rcloneEntry is an entry of the output of rclone lsjson.
+type rcloneEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// listFiles returns either the finished artifacts or the partial uploads in
+// Path.
+func (def *RcloneStorageDefinition) listFiles(partial bool) ([]StoredArtifact, error) {
+	remotePath := def.remotePath("")
+
+	var stdout bytes.Buffer
+	cmd := def.command("lsjson", "--files-only", remotePath)
+	cmd.Stdout = &stdout
+
+	err := def.run(cmd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s failed", remotePath)
+	}
+
+	var entries []rcloneEntry
+	err = json.Unmarshal(stdout.Bytes(), &entries)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse rclone lsjson output")
+	}
+
+	var artifacts []StoredArtifact
+	for _, entry := range entries {
+		if entry.IsDir || strings.HasSuffix(entry.Name, PartialSuffix) != partial {
+			continue
+		}
+
+		artifacts = append(artifacts, StoredArtifact{
+			Name:    entry.Name,
+			Size:    entry.Size,
+			ModTime: entry.ModTime,
+		})
+	}
+
+	return artifacts, nil
+}
+
+func (def *RcloneStorageDefinition) List() ([]StoredArtifact, error) {
+	return def.listFiles(false)
+}
+
+func (def *RcloneStorageDefinition) ListPartials() ([]StoredArtifact, error) {
+	return def.listFiles(true)
+}
+
+func (def *RcloneStorageDefinition) Fetch(artifact string, w io.Writer) error {
+	remotePath := def.remotePath(artifact)
+
+	cmd := def.command("cat", remotePath)
+	cmd.Stdout = w
+
+	err := def.run(cmd)
+	if err != nil {
+		return errors.Wrapf(err, "downloading %s failed", remotePath)
+	}
+
+	return nil
+}
+
+func (def *RcloneStorageDefinition) Delete(artifact string) error {
+	remotePath := def.remotePath(artifact)
+
+	cmd := def.command("deletefile", remotePath)
+	logVerbose(cmd)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.run(cmd)
+	if err != nil {
+		return errors.Wrapf(err, "deleting %s failed", remotePath)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRclone creates a shell script standing in for rclone, which keeps the
+// files of any remote in dir and logs its arguments to dir/log.
+func fakeRclone(t *testing.T, dir string) *RcloneStorageDefinition {
+	script := fmt.Sprintf(`#!/bin/sh
+root=%s
+echo "$*" >> "$root/log"
+cmd=$1
+shift
+while [ "${1#--}" != "$1" ]; do shift 2; done
+case $cmd in
+rcat) cat > "$root/${1#*:}" ;;
+moveto) mv "$root/${1#*:}" "$root/${2#*:}" ;;
+*) exit 1 ;;
+esac
+`, dir)
+
+	program := path.Join(dir, "rclone")
+	err := ioutil.WriteFile(program, []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &RcloneStorageDefinition{Remote: "fake", program: program}
+}
+
+func TestRcloneStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-rclone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	def := fakeRclone(t, dir)
+
+	assert.Nil(t, def.Store("db-20191201120000.sql.xz", strings.NewReader("dump"), 4))
+	assert.Nil(t, def.Store("files-20191201120000.tar.xz", strings.NewReader("files"), -1))
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "db-20191201120000.sql.xz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "dump", string(contents))
+
+	log, err := ioutil.ReadFile(path.Join(dir, "log"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(log), "rcat --size 4 fake:db-20191201120000.sql.xz.partial\n", "known sizes are passed on")
+	assert.Contains(t, string(log), "rcat fake:files-20191201120000.tar.xz.partial\n")
+	assert.Contains(t, string(log), "moveto fake:files-20191201120000.tar.xz.partial fake:files-20191201120000.tar.xz\n")
+}
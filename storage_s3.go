@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/errors"
+)
+
+const defaultS3Endpoint = "s3.amazonaws.com"
+
+const (
+	// s3MinPartSize and s3MaxPartSize in MiB
+	s3MinPartSize = 5
+	s3MaxPartSize = 5 * 1024
+	// s3StreamPartSize is used when the size of an artifact is not known in
+	// advance. An object can consist of at most 10,000 parts, so this allows
+	// for artifacts of up to 625 GiB, while one part is buffered in memory.
+	s3StreamPartSize = 64 * mebibyte
+)
+
+type S3StorageDefinition struct {
+	Format       string `yaml:"format"`
+	Bucket       string `yaml:"bucket"`
+	Prefix       string `yaml:"prefix"`
+	Endpoint     string `yaml:"endpoint"`
+	Region       string `yaml:"region"`
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    string `yaml:"secret_key"`
+	SessionToken string `yaml:"session_token"`
+	PathStyle    bool   `yaml:"path_style"`
+	// PartSize in MiB of multipart uploads. Leave empty to derive it from the
+	// size of each artifact, or use 64 MiB when streaming.
+	PartSize int `yaml:"part_size"`
+
+	client *minio.Client
+}
+
+// parseS3Endpoint splits an endpoint like "http://localhost:9000" into the
+// host part expected by minio and whether TLS should be used. Endpoints
+// without a scheme default to TLS.
+func parseS3Endpoint(endpoint string) (string, bool, error) {
+	if !strings.Contains(endpoint, "://") {
+		return strings.TrimSuffix(endpoint, "/"), true, nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", false, err
+	}
+
+	switch u.Scheme {
+	case "http":
+		return u.Host, false, nil
+	case "https":
+		return u.Host, true, nil
+	default:
+		return "", false, errors.Errorf("unsupported scheme '%s'", u.Scheme)
+	}
+}
+
+func analyzeS3StorageDefinition(def *S3StorageDefinition) error {
+	if len(def.Bucket) == 0 {
+		return errors.New("missing bucket")
+	}
+
+	if len(def.Endpoint) == 0 {
+		def.Endpoint = defaultS3Endpoint
+	}
+
+	host, secure, err := parseS3Endpoint(def.Endpoint)
+	if err != nil {
+		return errors.Wrap(err, "invalid endpoint")
+	}
+
+	if len(def.AccessKey) > 0 && len(def.SecretKey) == 0 {
+		return errors.New("missing secret key")
+	}
+
+	if len(def.SecretKey) > 0 && len(def.AccessKey) == 0 {
+		return errors.New("missing access key")
+	}
+
+	if def.PartSize != 0 && (def.PartSize < s3MinPartSize || def.PartSize > s3MaxPartSize) {
+		return errors.Errorf("part_size must be between %d and %d MiB, or left empty", s3MinPartSize, s3MaxPartSize)
+	}
+
+	var creds *credentials.Credentials
+	if len(def.AccessKey) > 0 {
+		creds = credentials.NewStaticV4(def.AccessKey, def.SecretKey, def.SessionToken)
+	} else {
+		// Fall back to the usual places: environment, ~/.aws/credentials and
+		// the EC2/ECS instance metadata service
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	lookup := minio.BucketLookupAuto
+	if def.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+
+	def.Prefix = strings.Trim(def.Prefix, "/")
+
+	def.client, err = minio.New(host, &minio.Options{
+		Creds:        creds,
+		Secure:       secure,
+		Region:       def.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not create S3 client")
+	}
+
+	return nil
+}
+
+func (s3 *S3StorageDefinition) objectName(artifact string) string {
+	return path.Join(s3.Prefix, artifact)
+}
+
+// partSize returns the part size in bytes for an artifact of size bytes, or
+// of unknown size if it is negative. Zero lets minio-go pick it. Without a
+// size, minio-go would buffer parts sized for the largest possible object.
+func (s3 *S3StorageDefinition) partSize(size int64) uint64 {
+	if s3.PartSize > 0 {
+		return uint64(s3.PartSize) * mebibyte
+	}
+
+	if size < 0 {
+		return s3StreamPartSize
+	}
+
+	return 0
+}
+
+func (s3 *S3StorageDefinition) Store(artifact string, r io.Reader, size int64) error {
+	objectName := s3.objectName(artifact)
+
+	logVerbosef("S3: Uploading %s to s3://%s/%s", artifact, s3.Bucket, objectName)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	options := minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+		PartSize:    s3.partSize(size),
+	}
+
+	_, err := s3.client.PutObject(context.Background(), s3.Bucket, objectName, r, size, options)
+	if err != nil {
+		return errors.Wrapf(err, "uploading to s3://%s/%s failed", s3.Bucket, objectName)
+	}
+
+	return nil
+}
+
+// listPrefix is the prefix under which List finds artifacts.
+func (s3 *S3StorageDefinition) listPrefix() string {
+	if len(s3.Prefix) == 0 {
+		return ""
+	}
+
+	return s3.Prefix + "/"
+}
+
+func (s3 *S3StorageDefinition) List() ([]StoredArtifact, error) {
+	var artifacts []StoredArtifact
+
+	objects := s3.client.ListObjects(context.Background(), s3.Bucket, minio.ListObjectsOptions{
+		Prefix: s3.listPrefix(),
+	})
+
+	for object := range objects {
+		if object.Err != nil {
+			return nil, errors.Wrapf(object.Err, "listing s3://%s/%s failed", s3.Bucket, s3.Prefix)
+		}
+
+		// Common prefixes of nested objects
+		if strings.HasSuffix(object.Key, "/") {
+			continue
+		}
+
+		artifacts = append(artifacts, StoredArtifact{
+			Name:    strings.TrimPrefix(object.Key, s3.listPrefix()),
+			Size:    object.Size,
+			ModTime: object.LastModified,
+		})
+	}
+
+	return artifacts, nil
+}
+
+func (s3 *S3StorageDefinition) Fetch(artifact string, w io.Writer) error {
+	objectName := s3.objectName(artifact)
+
+	object, err := s3.client.GetObject(context.Background(), s3.Bucket, objectName, minio.GetObjectOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "downloading s3://%s/%s failed", s3.Bucket, objectName)
+	}
+	defer object.Close()
+
+	_, err = io.Copy(w, object)
+	if err != nil {
+		return errors.Wrapf(err, "downloading s3://%s/%s failed", s3.Bucket, objectName)
+	}
+
+	return nil
+}
+
+func (s3 *S3StorageDefinition) Delete(artifact string) error {
+	objectName := s3.objectName(artifact)
+
+	logVerbosef("S3: Deleting s3://%s/%s", s3.Bucket, objectName)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := s3.client.RemoveObject(context.Background(), s3.Bucket, objectName, minio.RemoveObjectOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "deleting s3://%s/%s failed", s3.Bucket, objectName)
+	}
+
+	return nil
+}
@@ -0,0 +1,794 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const sftpDialTimeout = 30 * time.Second
+
+// sftpResumeTailWindow is how much of the end of a partial upload is compared
+// against the artifact when the server cannot hash it.
+const sftpResumeTailWindow = 1 << 20
+
+type SFTPStorageDefinition struct {
+	Format string `yaml:"format"`
+	User   string `yaml:"user"`
+	Host   string `yaml:"host"`
+	Path   string `yaml:"path"`
+	Port   int    `yaml:"port"`
+	Key    string `yaml:"key"`
+
+	// Host key verification: either a pinned host key, or a known_hosts file
+	// which defaults to ~/.ssh/known_hosts. The pinned key is a public key
+	// as in known_hosts, or a fingerprint as printed by ssh-keygen -l
+	// (SHA256:... or MD5:...), optionally preceded by the key type. With
+	// TrustOnFirstUse unknown hosts are added to the known_hosts file instead
+	// of being rejected.
+	KnownHosts      string `yaml:"known_hosts"`
+	HostKey         string `yaml:"host_key"`
+	TrustOnFirstUse bool   `yaml:"trust_on_first_use"`
+
+	// Parsed HostKey: either the key or its fingerprint and maybe type
+	pinnedKey         ssh.PublicKey
+	pinnedKeyType     string
+	pinnedFingerprint string
+
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// hostKeyMismatchError is returned by the host key callback when the server
+// presents a key other than the pinned one.
+type hostKeyMismatchError struct {
+	error
+}
+
+func analyzeSFTPStorageDefinition(def *SFTPStorageDefinition) error {
+	if len(def.User) == 0 {
+		return errors.New("missing user")
+	}
+
+	if len(def.Host) == 0 {
+		return errors.New("missing host")
+	}
+
+	if len(def.Path) == 0 {
+		return errors.New("missing remote path")
+	}
+
+	if def.Port == 0 {
+		def.Port = 22
+	}
+
+	if len(def.Key) > 0 {
+		if _, err := loadPrivateKey(def.Key); err != nil {
+			return errors.Wrap(err, "invalid key")
+		}
+	}
+
+	return analyzeSFTPHostKeyVerification(def)
+}
+
+func analyzeSFTPHostKeyVerification(def *SFTPStorageDefinition) error {
+	if len(def.HostKey) > 0 {
+		if len(def.KnownHosts) > 0 {
+			return errors.New("host_key and known_hosts are mutually exclusive")
+		}
+
+		if def.TrustOnFirstUse {
+			return errors.New("trust_on_first_use cannot be used with a pinned host_key")
+		}
+
+		return def.parseHostKey()
+	}
+
+	if len(def.KnownHosts) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return errors.Wrap(err, "could not locate default known_hosts")
+		}
+
+		def.KnownHosts = path.Join(home, ".ssh", "known_hosts")
+	}
+
+	if _, err := os.Stat(def.KnownHosts); os.IsNotExist(err) && def.TrustOnFirstUse {
+		err := os.MkdirAll(filepath.Dir(def.KnownHosts), 0700)
+		if err != nil {
+			return errors.Wrap(err, "could not create known_hosts directory")
+		}
+
+		err = ioutil.WriteFile(def.KnownHosts, nil, 0600)
+		if err != nil {
+			return errors.Wrap(err, "could not create known_hosts")
+		}
+	}
+
+	if _, err := knownhosts.New(def.KnownHosts); err != nil {
+		return errors.Wrap(err, "invalid known_hosts")
+	}
+
+	return nil
+}
+
+func isFingerprint(s string) bool {
+	return strings.HasPrefix(s, "SHA256:") || strings.HasPrefix(s, "MD5:")
+}
+
+// parseHostKey accepts a fingerprint, a key type followed by a fingerprint,
+// or a public key, e.g. a line of known_hosts without the host names.
+func (def *SFTPStorageDefinition) parseHostKey() error {
+	fields := strings.Fields(def.HostKey)
+
+	if len(fields) == 1 && isFingerprint(fields[0]) {
+		def.pinnedFingerprint = fields[0]
+		return nil
+	}
+
+	if len(fields) == 2 && isFingerprint(fields[1]) {
+		def.pinnedKeyType = fields[0]
+		def.pinnedFingerprint = fields[1]
+		return nil
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(def.HostKey))
+	if err != nil {
+		return errors.New("host_key must be a SHA256: or MD5: fingerprint, optionally preceded by the key type, or a public key")
+	}
+
+	def.pinnedKey = key
+
+	return nil
+}
+
+func (def *SFTPStorageDefinition) checkPinnedHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if def.pinnedKey != nil {
+		if !bytes.Equal(key.Marshal(), def.pinnedKey.Marshal()) {
+			return hostKeyMismatchError{errors.Errorf("host key mismatch for %s: got %s %s, expected %s %s", hostname,
+				key.Type(), ssh.FingerprintSHA256(key), def.pinnedKey.Type(), ssh.FingerprintSHA256(def.pinnedKey))}
+		}
+
+		return nil
+	}
+
+	var fingerprint string
+	if strings.HasPrefix(def.pinnedFingerprint, "MD5:") {
+		fingerprint = "MD5:" + ssh.FingerprintLegacyMD5(key)
+	} else {
+		fingerprint = ssh.FingerprintSHA256(key)
+	}
+
+	if fingerprint != def.pinnedFingerprint {
+		return hostKeyMismatchError{errors.Errorf("host key mismatch for %s: got %s %s, expected %s",
+			hostname, key.Type(), fingerprint, def.pinnedFingerprint)}
+	}
+
+	return nil
+}
+
+// algorithmsForKeyType returns the host key algorithms which verify with a
+// key of keyType.
+func algorithmsForKeyType(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return []string{keyType}
+}
+
+// knownHostKeyTypes returns the types of the keys known_hosts has for addr,
+// in the order they are listed.
+func (def *SFTPStorageDefinition) knownHostKeyTypes(addr string) ([]string, error) {
+	callback, err := knownhosts.New(def.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like ssh-keyscan, look up the host with a key it cannot have, so the
+	// error lists all keys it does have
+	_, probe, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	probeKey, err := ssh.NewPublicKey(probe.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	err = callback(addr, &net.TCPAddr{IP: net.IPv4zero}, probeKey)
+
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil, err
+	}
+
+	var types []string
+	for _, known := range keyErr.Want {
+		types = append(types, known.Key.Type())
+	}
+
+	return types, nil
+}
+
+// hostKeyAlgorithms returns the host key algorithms to offer, one list per
+// connection attempt. Otherwise the server picks the key by the client's
+// default preference, which need not be the one that is trusted when it has
+// several. A fingerprint without a key type is tried with every type. Nil
+// offers the defaults, for hosts which are not known yet.
+func (def *SFTPStorageDefinition) hostKeyAlgorithms(addr string) ([][]string, error) {
+	if def.pinnedKey != nil {
+		return [][]string{algorithmsForKeyType(def.pinnedKey.Type())}, nil
+	}
+
+	if len(def.pinnedKeyType) > 0 {
+		return [][]string{algorithmsForKeyType(def.pinnedKeyType)}, nil
+	}
+
+	if len(def.pinnedFingerprint) > 0 {
+		return [][]string{
+			{ssh.KeyAlgoED25519},
+			{ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521},
+			algorithmsForKeyType(ssh.KeyAlgoRSA),
+		}, nil
+	}
+
+	types, err := def.knownHostKeyTypes(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(types) == 0 {
+		return [][]string{nil}, nil
+	}
+
+	var algorithms []string
+	seen := make(map[string]bool)
+
+	for _, keyType := range types {
+		for _, algorithm := range algorithmsForKeyType(keyType) {
+			if !seen[algorithm] {
+				seen[algorithm] = true
+				algorithms = append(algorithms, algorithm)
+			}
+		}
+	}
+
+	return [][]string{algorithms}, nil
+}
+
+func (def *SFTPStorageDefinition) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if len(def.HostKey) > 0 {
+		return def.checkPinnedHostKey, nil
+	}
+
+	callback, err := knownhosts.New(def.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+
+		if len(keyErr.Want) > 0 {
+			return errors.Errorf("host key mismatch for %s: got %s, which does not match %s:%d",
+				hostname, ssh.FingerprintSHA256(key), keyErr.Want[0].Filename, keyErr.Want[0].Line)
+		}
+
+		if !def.TrustOnFirstUse {
+			return errors.Errorf("host %s (%s) is not in %s", hostname, ssh.FingerprintSHA256(key), def.KnownHosts)
+		}
+
+		log.Printf("SFTP: Trusting new host key %s for %s", ssh.FingerprintSHA256(key), hostname)
+
+		return appendKnownHost(def.KnownHosts, hostname, key)
+	}, nil
+}
+
+func appendKnownHost(file string, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not record host key")
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n")
+	if err != nil {
+		return errors.Wrap(err, "could not record host key")
+	}
+
+	return nil
+}
+
+func loadPrivateKey(file string) (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		return nil, errors.Errorf("%s is protected by a passphrase, load it into ssh-agent instead", file)
+	}
+
+	return signer, err
+}
+
+// authMethods mirrors what the OpenSSH client would try: the configured key
+// if there is one, otherwise the agent and the default identity files.
+func (def *SFTPStorageDefinition) authMethods() ([]ssh.AuthMethod, func(), error) {
+	if len(def.Key) > 0 {
+		signer, err := loadPrivateKey(def.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, func() {}, nil
+	}
+
+	var methods []ssh.AuthMethod
+	cleanup := func() {}
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); len(socket) > 0 {
+		agentConn, err := net.Dial("unix", socket)
+		if err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+			cleanup = func() { agentConn.Close() }
+		} else {
+			logVerbosef("SFTP: could not connect to ssh-agent: %s", err)
+		}
+	}
+
+	home, err := os.UserHomeDir()
+	if err == nil {
+		var signers []ssh.Signer
+
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			signer, err := loadPrivateKey(path.Join(home, ".ssh", name))
+			if err == nil {
+				signers = append(signers, signer)
+			}
+		}
+
+		if len(signers) > 0 {
+			methods = append(methods, ssh.PublicKeys(signers...))
+		}
+	}
+
+	if len(methods) == 0 {
+		cleanup()
+		return nil, nil, errors.New("no key configured and neither ssh-agent nor default identities are available")
+	}
+
+	return methods, cleanup, nil
+}
+
+// connect opens the SSH connection and SFTP session on first use. The
+// connection is kept open for all artifacts of a run until Close is called.
+func (def *SFTPStorageDefinition) connect() error {
+	if def.client != nil {
+		return nil
+	}
+
+	auth, cleanup, err := def.authMethods()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	hostKeyCallback, err := def.hostKeyCallback()
+	if err != nil {
+		return errors.Wrap(err, "could not load known_hosts")
+	}
+
+	addr := net.JoinHostPort(def.Host, strconv.Itoa(def.Port))
+
+	hostKeyAlgorithms, err := def.hostKeyAlgorithms(addr)
+	if err != nil {
+		return errors.Wrap(err, "could not look up known host keys")
+	}
+
+	logVerbosef("SFTP: Connecting to %s@%s", def.User, addr)
+
+	var conn *ssh.Client
+	var mismatchErr error
+
+	// A server may have the pinned key in addition to the one it presented,
+	// or may not have a key of the type tried
+	for _, algorithms := range hostKeyAlgorithms {
+		config := &ssh.ClientConfig{
+			User:              def.User,
+			Auth:              auth,
+			HostKeyCallback:   hostKeyCallback,
+			HostKeyAlgorithms: algorithms,
+			Timeout:           sftpDialTimeout,
+		}
+
+		conn, err = ssh.Dial("tcp", addr, config)
+
+		var mismatch hostKeyMismatchError
+		var negotiation *ssh.AlgorithmNegotiationError
+
+		if errors.As(err, &mismatch) {
+			mismatchErr = err
+		} else if !errors.As(err, &negotiation) || negotiation.What != "host key" {
+			break
+		}
+	}
+
+	if err != nil && mismatchErr != nil {
+		err = mismatchErr
+	}
+
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to %s", addr)
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return errors.Wrapf(err, "could not start SFTP session on %s", addr)
+	}
+
+	err = client.MkdirAll(def.Path)
+	if err != nil {
+		client.Close()
+		conn.Close()
+		return errors.Wrapf(err, "could not create remote path %s", def.Path)
+	}
+
+	def.conn = conn
+	def.client = client
+
+	return nil
+}
+
+func (def *SFTPStorageDefinition) Close() error {
+	if def.client == nil {
+		return nil
+	}
+
+	def.client.Close()
+	err := def.conn.Close()
+
+	def.client = nil
+	def.conn = nil
+
+	return err
+}
+
+func (def *SFTPStorageDefinition) remotePath(artifact string) string {
+	return path.Join(def.Path, artifact)
+}
+
+func (def *SFTPStorageDefinition) Store(artifact string, r io.Reader, size int64) error {
+	remotePath := def.remotePath(artifact)
+
+	logVerbosef("SFTP: Uploading %s to %s:%s", artifact, def.Host, remotePath)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	partialPath := remotePath + PartialSuffix
+
+	var offset int64
+	source, contents, resumable := resumableSourceOf(r)
+	if resumable {
+		offset = def.resumeOffset(partialPath, contents, size)
+	}
+
+	var destination *sftp.File
+	if offset > 0 {
+		log.Printf("SFTP: Resuming upload of %s at %d of %d bytes", artifact, offset, size)
+
+		destination, err = def.resume(partialPath, source, offset)
+	} else {
+		destination, err = def.client.Create(partialPath)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "could not open %s", partialPath)
+	}
+
+	// The partial file is kept on failure, so a retry can resume it. The
+	// connection is likely broken, so it is closed to reconnect next time.
+	_, err = destination.ReadFrom(r)
+	if err != nil {
+		destination.Close()
+		def.Close()
+		return errors.Wrapf(err, "writing %s failed", partialPath)
+	}
+
+	err = destination.Close()
+	if err != nil {
+		def.Close()
+		return errors.Wrapf(err, "closing %s failed", partialPath)
+	}
+
+	err = def.rename(partialPath, remotePath)
+	if err != nil {
+		return errors.Wrapf(err, "renaming %s to %s failed", partialPath, remotePath)
+	}
+
+	return nil
+}
+
+// resumableSource is a source which can continue reading after the part
+// already uploaded.
+type resumableSource interface {
+	io.Reader
+	io.Seeker
+}
+
+// resumableSourceOf returns r as a resumableSource together with direct
+// access to its contents, to compare its beginning against a partial upload.
+// For throttled files the contents bypass the bandwidth limit.
+func resumableSourceOf(r io.Reader) (resumableSource, io.ReaderAt, bool) {
+	source, ok := r.(resumableSource)
+	if !ok {
+		return nil, nil, false
+	}
+
+	if throttled, ok := r.(interface{ Unthrottled() io.ReaderAt }); ok {
+		return source, throttled.Unthrottled(), true
+	}
+
+	contents, ok := r.(io.ReaderAt)
+	return source, contents, ok
+}
+
+// resumeOffset returns the size of a partial upload left behind by an
+// interrupted attempt if its contents match the beginning of source.
+// Otherwise the upload has to start from scratch.
+//
+// The partial upload is hashed on the server, so it does not have to be
+// downloaded. Accounts restricted to SFTP cannot run commands; for them only
+// the last sftpResumeTailWindow bytes are compared. That misses corruption
+// further in, but the partial upload was written from the same artifact,
+// whose name includes the time it was created.
+func (def *SFTPStorageDefinition) resumeOffset(partialPath string, source io.ReaderAt, size int64) int64 {
+	stat, err := def.client.Stat(partialPath)
+	if err != nil || stat.Size() == 0 || stat.Size() > size {
+		return 0
+	}
+
+	offset := stat.Size()
+
+	remoteSum, err := def.remoteSHA256(partialPath, offset)
+	if err != nil {
+		logVerbosef("SFTP: Could not hash %s on the server, comparing its end only: %s", partialPath, err)
+
+		if !def.tailMatches(partialPath, source, offset) {
+			logVerbosef("SFTP: %s does not match the artifact, restarting upload", partialPath)
+			return 0
+		}
+
+		return offset
+	}
+
+	localHash := sha256.New()
+	_, err = io.Copy(localHash, io.NewSectionReader(source, 0, offset))
+	if err != nil {
+		logVerbosef("SFTP: Could not read source of %s, restarting upload: %s", partialPath, err)
+		return 0
+	}
+
+	if !bytes.Equal(remoteSum, localHash.Sum(nil)) {
+		logVerbosef("SFTP: %s does not match the artifact, restarting upload", partialPath)
+		return 0
+	}
+
+	return offset
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// remoteSHA256 hashes the first n bytes of file on the server, which needs
+// shell access with head and sha256sum.
+func (def *SFTPStorageDefinition) remoteSHA256(file string, n int64) ([]byte, error) {
+	session, err := def.conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	out, err := session.Output(fmt.Sprintf("head -c %d -- %s | sha256sum", n, shellQuote(file)))
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, errors.New("sha256sum printed nothing")
+	}
+
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, errors.Errorf("unexpected sha256sum output %q", out)
+	}
+
+	return sum, nil
+}
+
+// tailMatches compares the last bytes before offset of the partial upload
+// and of source.
+func (def *SFTPStorageDefinition) tailMatches(partialPath string, source io.ReaderAt, offset int64) bool {
+	window := int64(sftpResumeTailWindow)
+	if offset < window {
+		window = offset
+	}
+
+	remote, err := def.client.Open(partialPath)
+	if err != nil {
+		return false
+	}
+	defer remote.Close()
+
+	remoteTail := make([]byte, window)
+	_, err = remote.ReadAt(remoteTail, offset-window)
+	if err != nil && err != io.EOF {
+		return false
+	}
+
+	localTail := make([]byte, window)
+	_, err = source.ReadAt(localTail, offset-window)
+	if err != nil && err != io.EOF {
+		return false
+	}
+
+	return bytes.Equal(remoteTail, localTail)
+}
+
+// resume opens a partial upload for writing at offset and skips source to
+// the same position.
+func (def *SFTPStorageDefinition) resume(partialPath string, source resumableSource, offset int64) (*sftp.File, error) {
+	_, err := source.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	destination, err := def.client.OpenFile(partialPath, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = destination.Seek(offset, io.SeekStart)
+	if err != nil {
+		destination.Close()
+		return nil, err
+	}
+
+	return destination, nil
+}
+
+// rename moves a finished upload into place. Plain SFTP rename fails if the
+// target exists, so the OpenSSH extension which replaces it atomically is
+// preferred and other servers get the target removed first.
+func (def *SFTPStorageDefinition) rename(oldname, newname string) error {
+	if _, ok := def.client.HasExtension("posix-rename@openssh.com"); ok {
+		return def.client.PosixRename(oldname, newname)
+	}
+
+	if _, err := def.client.Lstat(newname); err == nil {
+		err = def.client.Remove(newname)
+		if err != nil {
+			return err
+		}
+	}
+
+	return def.client.Rename(oldname, newname)
+}
+
+// listFiles returns either the finished artifacts or the partial uploads in
+// the remote path.
+func (def *SFTPStorageDefinition) listFiles(partial bool) ([]StoredArtifact, error) {
+	err := def.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := def.client.ReadDir(def.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing %s failed", def.Path)
+	}
+
+	var artifacts []StoredArtifact
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasSuffix(file.Name(), PartialSuffix) != partial {
+			continue
+		}
+
+		artifacts = append(artifacts, StoredArtifact{
+			Name:    file.Name(),
+			Size:    file.Size(),
+			ModTime: file.ModTime(),
+		})
+	}
+
+	return artifacts, nil
+}
+
+func (def *SFTPStorageDefinition) List() ([]StoredArtifact, error) {
+	return def.listFiles(false)
+}
+
+func (def *SFTPStorageDefinition) ListPartials() ([]StoredArtifact, error) {
+	return def.listFiles(true)
+}
+
+func (def *SFTPStorageDefinition) Fetch(artifact string, w io.Writer) error {
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	remotePath := def.remotePath(artifact)
+
+	source, err := def.client.Open(remotePath)
+	if err != nil {
+		return errors.Wrapf(err, "could not open %s", remotePath)
+	}
+	defer source.Close()
+
+	_, err = source.WriteTo(w)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s failed", remotePath)
+	}
+
+	return nil
+}
+
+func (def *SFTPStorageDefinition) Delete(artifact string) error {
+	remotePath := def.remotePath(artifact)
+
+	logVerbosef("SFTP: Deleting %s:%s", def.Host, remotePath)
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.connect()
+	if err != nil {
+		return err
+	}
+
+	err = def.client.Remove(remotePath)
+	if err != nil {
+		return errors.Wrapf(err, "deleting %s failed", remotePath)
+	}
+
+	return nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type testSFTPServer struct {
+	Addr string
+	Port int
+	// HostKey is the server's ed25519 key. Like a stock OpenSSH server it
+	// also has ECDSAHostKey, which the client prefers by default.
+	HostKey      ssh.Signer
+	ECDSAHostKey ssh.Signer
+	KeyFile      string
+	listener net.Listener
+
+	connections int32
+	// exec makes the server run commands of exec requests when non-zero
+	exec int32
+	// received counts the bytes read from all clients
+	received int64
+	// sent counts the bytes written to all clients
+	sent int64
+	// dropAfter makes the server close the next connection after reading
+	// that many bytes from it
+	dropAfter int64
+}
+
+// testConn counts the bytes exchanged by the server and drops the
+// connection once remaining reaches zero, if it was set.
+type testConn struct {
+	net.Conn
+	server    *testSFTPServer
+	remaining int64
+}
+
+func (conn *testConn) Read(p []byte) (int, error) {
+	if conn.remaining > 0 && int64(len(p)) > conn.remaining {
+		p = p[:conn.remaining]
+	}
+
+	n, err := conn.Conn.Read(p)
+	atomic.AddInt64(&conn.server.received, int64(n))
+
+	if conn.remaining > 0 {
+		conn.remaining -= int64(n)
+		if conn.remaining == 0 {
+			conn.Conn.Close()
+		}
+	}
+
+	return n, err
+}
+
+func (conn *testConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	atomic.AddInt64(&conn.server.sent, int64(n))
+	return n, err
+}
+
+func newTestKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return priv, signer
+}
+
+// startTestSFTPServer runs an in-process SSH server offering the sftp
+// subsystem and accepting a freshly generated client key, which is written
+// to a temporary file for use as the storage's key. It has an ed25519 and an
+// ECDSA host key.
+func startTestSFTPServer(t *testing.T) *testSFTPServer {
+	dir, err := ioutil.TempDir("", "rika-sftp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	clientPriv, clientSigner := newTestKey(t)
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := path.Join(dir, "id_ed25519")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, hostSigner := newTestKey(t)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecdsaSigner, err := ssh.NewSignerFromKey(ecdsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+	config.AddHostKey(ecdsaSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &testSFTPServer{
+		Addr:     listener.Addr().String(),
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		HostKey:      hostSigner,
+		ECDSAHostKey: ecdsaSigner,
+		KeyFile:      keyFile,
+		listener:     listener,
+	}
+	t.Cleanup(server.Stop)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(&server.connections, 1)
+			conn = &testConn{
+				Conn:      conn,
+				server:    server,
+				remaining: atomic.SwapInt64(&server.dropAfter, 0),
+			}
+			go server.serve(conn, config)
+		}
+	}()
+
+	return server
+}
+
+func (server *testSFTPServer) Stop() {
+	server.listener.Close()
+}
+
+func (server *testSFTPServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				if req.Type == "exec" && atomic.LoadInt32(&server.exec) != 0 {
+					req.Reply(true, nil)
+					runTestExec(channel, string(req.Payload[4:]))
+					return
+				}
+
+				isSFTP := req.Type == "subsystem" && len(req.Payload) > 4 &&
+					string(req.Payload[4:4+binary.BigEndian.Uint32(req.Payload)]) == "sftp"
+				req.Reply(isSFTP, nil)
+
+				if isSFTP {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						channel.Close()
+						return
+					}
+					server.Serve()
+					server.Close()
+				}
+			}
+		}()
+	}
+}
+
+// runTestExec runs command locally with its output sent to channel.
+func runTestExec(channel ssh.Channel, command string) {
+	defer channel.Close()
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+
+	status := make([]byte, 4)
+	if err := cmd.Run(); err != nil {
+		binary.BigEndian.PutUint32(status, 1)
+	}
+	channel.SendRequest("exit-status", false, status)
+}
+
+func TestSFTPStorageStore(t *testing.T) {
+	server := startTestSFTPServer(t)
+
+	remoteDir, err := ioutil.TempDir("", "rika-sftp-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localDir, err := ioutil.TempDir("", "rika-sftp-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localDir)
+
+	def := &SFTPStorageDefinition{
+		User: "test",
+		Host: "127.0.0.1",
+		Port: server.Port,
+		Path: path.Join(remoteDir, "nested", "backups"),
+		Key:  server.KeyFile,
+
+		HostKey: ssh.FingerprintSHA256(server.HostKey.PublicKey()),
+	}
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	defer def.Close()
+
+	for i := 0; i < 2; i++ {
+		artifact := path.Join(localDir, "test-2019120112000"+strconv.Itoa(i)+".tar.xz")
+		assert.Nil(t, ioutil.WriteFile(artifact, []byte("artifact "+strconv.Itoa(i)), 0644))
+		assert.Nil(t, storeFile(def, artifact))
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&server.connections), "all artifacts should share one connection")
+
+	contents, err := ioutil.ReadFile(path.Join(def.Path, "test-20191201120001.tar.xz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "artifact 1", string(contents))
+
+	// Storing again replaces the existing artifact
+	artifact := path.Join(localDir, "test-20191201120001.tar.xz")
+	assert.Nil(t, ioutil.WriteFile(artifact, []byte("replaced"), 0644))
+	assert.Nil(t, storeFile(def, artifact))
+
+	contents, err = ioutil.ReadFile(path.Join(def.Path, "test-20191201120001.tar.xz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "replaced", string(contents))
+
+	// Leftovers of interrupted uploads are not listed as artifacts
+	assert.Nil(t, ioutil.WriteFile(path.Join(def.Path, "test-20191201120002.tar.xz"+PartialSuffix), nil, 0644))
+
+	artifacts, err := def.List()
+	assert.Nil(t, err)
+	assert.Len(t, artifacts, 2)
+
+	partials, err := def.ListPartials()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"test-20191201120002.tar.xz" + PartialSuffix}, names(partials))
+	assert.Nil(t, def.Delete("test-20191201120002.tar.xz"+PartialSuffix))
+
+	assertStorageRoundTrip(t, def)
+
+	def.Key = path.Join(localDir, "missing")
+	def.Close()
+	assert.NotNil(t, storeFile(def, path.Join(localDir, "test-20191201120000.tar.xz")))
+}
+
+func TestSFTPResumeUpload(t *testing.T) {
+	t.Run("hashed on the server", func(t *testing.T) {
+		testSFTPResumeUpload(t, true)
+	})
+	t.Run("without shell access", func(t *testing.T) {
+		testSFTPResumeUpload(t, false)
+	})
+}
+
+func testSFTPResumeUpload(t *testing.T, shell bool) {
+	server := startTestSFTPServer(t)
+	if shell {
+		server.exec = 1
+	}
+
+	remoteDir, err := ioutil.TempDir("", "rika-sftp-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localDir, err := ioutil.TempDir("", "rika-sftp-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localDir)
+
+	def := &SFTPStorageDefinition{
+		User:    "test",
+		Host:    "127.0.0.1",
+		Port:    server.Port,
+		Path:    remoteDir,
+		Key:     server.KeyFile,
+		HostKey: ssh.FingerprintSHA256(server.HostKey.PublicKey()),
+	}
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	defer def.Close()
+
+	const size = 8 << 20
+
+	contents := make([]byte, size)
+	_, err = rand.Read(contents)
+	assert.Nil(t, err)
+
+	const name = "large-20191201120000.tar.xz"
+	artifact := path.Join(localDir, name)
+	assert.Nil(t, ioutil.WriteFile(artifact, contents, 0644))
+
+	partialPath := path.Join(remoteDir, name+PartialSuffix)
+
+	// Kill the connection halfway through the upload
+	atomic.StoreInt64(&server.dropAfter, size/2)
+	assert.NotNil(t, storeFile(def, artifact))
+
+	stat, err := os.Stat(partialPath)
+	if !assert.Nil(t, err, "partial upload should be kept") {
+		return
+	}
+	assert.True(t, stat.Size() > sftpResumeTailWindow && stat.Size() < size, "partial upload has %d bytes", stat.Size())
+
+	atomic.StoreInt64(&server.received, 0)
+	atomic.StoreInt64(&server.sent, 0)
+	assert.Nil(t, storeFile(def, artifact))
+	assert.True(t, atomic.LoadInt64(&server.received) < size, "only the rest should be uploaded")
+	if shell {
+		assert.True(t, atomic.LoadInt64(&server.sent) < 64<<10, "the partial upload should not be downloaded")
+	} else {
+		assert.True(t, atomic.LoadInt64(&server.sent) < stat.Size()-sftpResumeTailWindow/2, "only the end of the partial upload should be downloaded")
+	}
+
+	stored, err := ioutil.ReadFile(path.Join(remoteDir, name))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(contents, stored), "resumed artifact should match")
+
+	_, err = os.Stat(partialPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// A partial upload which does not match the artifact is replaced
+	assert.Nil(t, ioutil.WriteFile(partialPath, []byte("something else"), 0644))
+	assert.Nil(t, storeFile(def, artifact))
+
+	stored, err = ioutil.ReadFile(path.Join(remoteDir, name))
+	assert.Nil(t, err)
+	assert.True(t, bytes.Equal(contents, stored), "mismatching partial upload should be restarted")
+}
+
+func TestSFTPHostKeyVerification(t *testing.T) {
+	server := startTestSFTPServer(t)
+	_, otherHostKey := newTestKey(t)
+
+	dir, err := ioutil.TempDir("", "rika-sftp-known-hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newDef := func() *SFTPStorageDefinition {
+		return &SFTPStorageDefinition{
+			User: "test",
+			Host: "127.0.0.1",
+			Port: server.Port,
+			Path: dir,
+			Key:  server.KeyFile,
+		}
+	}
+
+	// Pinned fingerprints
+	def := newDef()
+	def.HostKey = ssh.FingerprintSHA256(server.HostKey.PublicKey())
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.Nil(t, def.connect())
+	def.Close()
+
+	def = newDef()
+	def.HostKey = "MD5:" + ssh.FingerprintLegacyMD5(server.HostKey.PublicKey())
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.Nil(t, def.connect())
+	def.Close()
+
+	def = newDef()
+	def.HostKey = ssh.FingerprintSHA256(server.ECDSAHostKey.PublicKey())
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.Nil(t, def.connect(), "every key type is tried")
+	def.Close()
+
+	def = newDef()
+	def.HostKey = ssh.KeyAlgoED25519 + " " + ssh.FingerprintSHA256(server.HostKey.PublicKey())
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.Nil(t, def.connect())
+	def.Close()
+
+	def = newDef()
+	def.HostKey = ssh.FingerprintSHA256(otherHostKey.PublicKey())
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	err = def.connect()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "host key mismatch")
+	}
+
+	def = newDef()
+	def.HostKey = "ab:cd:ef"
+	assert.NotNil(t, analyzeSFTPStorageDefinition(def))
+
+	// Pinned public keys
+	def = newDef()
+	def.HostKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(server.HostKey.PublicKey())))
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.Nil(t, def.connect())
+	def.Close()
+
+	def = newDef()
+	def.HostKey = string(ssh.MarshalAuthorizedKey(otherHostKey.PublicKey()))
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.NotNil(t, def.connect())
+
+	// Only the ed25519 key is known, which the server is asked for although
+	// the client prefers ECDSA
+	ed25519Only := path.Join(dir, "ed25519_known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, server.HostKey.PublicKey())
+	assert.Nil(t, ioutil.WriteFile(ed25519Only, []byte(line+"\n"), 0600))
+
+	def = newDef()
+	def.KnownHosts = ed25519Only
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.Nil(t, def.connect())
+	def.Close()
+
+	// Unknown hosts are rejected unless trust on first use is enabled
+	knownHosts := path.Join(dir, "ssh", "known_hosts")
+
+	def = newDef()
+	def.KnownHosts = knownHosts
+	assert.NotNil(t, analyzeSFTPStorageDefinition(def), "missing known_hosts should be rejected")
+
+	def.TrustOnFirstUse = true
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.Nil(t, def.connect())
+	def.Close()
+
+	def = newDef()
+	def.KnownHosts = knownHosts
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.Nil(t, def.connect(), "host recorded on first use should now be trusted")
+	def.Close()
+
+	// A changed host key must fail even with trust on first use
+	line = knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, otherHostKey.PublicKey())
+	assert.Nil(t, ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0600))
+
+	def = newDef()
+	def.KnownHosts = knownHosts
+	def.TrustOnFirstUse = true
+	assert.Nil(t, analyzeSFTPStorageDefinition(def))
+	assert.NotNil(t, def.connect())
+}
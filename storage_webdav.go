@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type WebDAVStorageDefinition struct {
+	Format       string `yaml:"format"`
+	URL          string `yaml:"url"`
+	User         string `yaml:"user"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+	Path         string `yaml:"path"`
+
+	baseURL            *url.URL
+	client             *http.Client
+	collectionsCreated bool
+}
+
+func analyzeWebDAVStorageDefinition(def *WebDAVStorageDefinition) error {
+	if len(def.URL) == 0 {
+		return errors.New("missing url")
+	}
+
+	baseURL, err := url.Parse(def.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid url")
+	}
+
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return errors.Errorf("unsupported scheme '%s'", baseURL.Scheme)
+	}
+
+	if len(def.Password) > 0 && len(def.PasswordFile) > 0 {
+		return errors.New("password and password_file are mutually exclusive")
+	}
+
+	if len(def.PasswordFile) > 0 {
+		password, err := ioutil.ReadFile(def.PasswordFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read password file")
+		}
+
+		def.Password = strings.TrimRight(string(password), "\r\n")
+	}
+
+	def.baseURL = baseURL
+	def.Path = strings.Trim(def.Path, "/")
+	def.client = &http.Client{}
+
+	return nil
+}
+
+// resourceURL returns the URL of the given path below the base URL, with
+// every segment escaped.
+func (def *WebDAVStorageDefinition) resourceURL(p string) string {
+	u := *def.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(p, "/")
+	u.RawPath = ""
+	return u.String()
+}
+
+// request sends a request and returns the response with its body still
+// open.
+func (def *WebDAVStorageDefinition) request(method string, p string, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, def.resourceURL(p), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	if len(def.User) > 0 {
+		req.SetBasicAuth(def.User, def.Password)
+	}
+
+	return def.client.Do(req)
+}
+
+// do sends a request without caring about the response body.
+func (def *WebDAVStorageDefinition) do(method string, p string, body io.Reader, size int64) (*http.Response, error) {
+	var header http.Header
+	if body != nil {
+		header = http.Header{"Content-Type": []string{"application/octet-stream"}}
+	}
+
+	resp, err := def.request(method, p, header, body, size)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return resp, nil
+}
+
+// createCollections issues MKCOL for every segment of Path, as WebDAV does
+// not create intermediate collections on PUT.
+func (def *WebDAVStorageDefinition) createCollections() error {
+	if def.collectionsCreated || len(def.Path) == 0 {
+		return nil
+	}
+
+	var current string
+	for _, segment := range strings.Split(def.Path, "/") {
+		current = path.Join(current, segment)
+
+		resp, err := def.do("MKCOL", current+"/", nil, 0)
+		if err != nil {
+			return errors.Wrapf(err, "MKCOL %s failed", current)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusCreated, http.StatusOK:
+		// 405 is returned by servers if the collection already exists
+		case http.StatusMethodNotAllowed:
+		default:
+			return errors.Errorf("MKCOL %s failed: %s", current, resp.Status)
+		}
+	}
+
+	def.collectionsCreated = true
+
+	return nil
+}
+
+func (def *WebDAVStorageDefinition) Store(artifact string, r io.Reader, size int64) error {
+	remotePath := path.Join(def.Path, artifact)
+
+	logVerbosef("WebDAV: Uploading %s to %s", artifact, def.resourceURL(remotePath))
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	err := def.createCollections()
+	if err != nil {
+		return err
+	}
+
+	resp, err := def.do("PUT", remotePath, r, size)
+	if err != nil {
+		return errors.Wrapf(err, "PUT %s failed", remotePath)
+	}
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return errors.Errorf("PUT %s failed: %s", remotePath, resp.Status)
+	}
+
+	return nil
+}
+
+const webdavPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:">
+  <prop>
+    <resourcetype/>
+    <getcontentlength/>
+    <getlastmodified/>
+  </prop>
+</propfind>`
+
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength int64  `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (def *WebDAVStorageDefinition) List() ([]StoredArtifact, error) {
+	header := http.Header{
+		"Depth":        []string{"1"},
+		"Content-Type": []string{"application/xml; charset=utf-8"},
+	}
+
+	resp, err := def.request("PROPFIND", def.Path+"/", header, strings.NewReader(webdavPropfindBody), int64(len(webdavPropfindBody)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "PROPFIND %s failed", def.Path)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, errors.Errorf("PROPFIND %s failed: %s", def.Path, resp.Status)
+	}
+
+	var multistatus webdavMultistatus
+	err = xml.NewDecoder(resp.Body).Decode(&multistatus)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse PROPFIND response")
+	}
+
+	var artifacts []StoredArtifact
+	for _, response := range multistatus.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid href '%s'", response.Href)
+		}
+
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") || propstat.Prop.ResourceType.Collection != nil {
+				continue
+			}
+
+			artifact := StoredArtifact{
+				Name: path.Base(href.Path),
+				Size: propstat.Prop.ContentLength,
+			}
+
+			if modTime, err := http.ParseTime(propstat.Prop.LastModified); err == nil {
+				artifact.ModTime = modTime
+			}
+
+			artifacts = append(artifacts, artifact)
+		}
+	}
+
+	return artifacts, nil
+}
+
+func (def *WebDAVStorageDefinition) Fetch(artifact string, w io.Writer) error {
+	remotePath := path.Join(def.Path, artifact)
+
+	resp, err := def.request("GET", remotePath, nil, nil, 0)
+	if err != nil {
+		return errors.Wrapf(err, "GET %s failed", remotePath)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s failed: %s", remotePath, resp.Status)
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "GET %s failed", remotePath)
+	}
+
+	return nil
+}
+
+func (def *WebDAVStorageDefinition) Delete(artifact string) error {
+	remotePath := path.Join(def.Path, artifact)
+
+	logVerbosef("WebDAV: Deleting %s", def.resourceURL(remotePath))
+
+	if GetOptions().DryRun {
+		return nil
+	}
+
+	resp, err := def.do("DELETE", remotePath, nil, 0)
+	if err != nil {
+		return errors.Wrapf(err, "DELETE %s failed", remotePath)
+	}
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return errors.Errorf("DELETE %s failed: %s", remotePath, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+func startTestWebDAVServer(t *testing.T, dir string) *httptest.Server {
+	handler := &webdav.Handler{
+		FileSystem: webdav.Dir(dir),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "test" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestWebDAVStorageStore(t *testing.T) {
+	remoteDir, err := ioutil.TempDir("", "rika-webdav-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(remoteDir)
+
+	localDir, err := ioutil.TempDir("", "rika-webdav-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(localDir)
+
+	server := startTestWebDAVServer(t, remoteDir)
+
+	passwordFile := path.Join(localDir, "password")
+	assert.Nil(t, ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600))
+
+	def := &WebDAVStorageDefinition{
+		URL:          server.URL + "/dav/",
+		User:         "test",
+		PasswordFile: passwordFile,
+		Path:         "/backups/site/",
+	}
+	assert.Nil(t, os.Mkdir(path.Join(remoteDir, "dav"), 0755))
+	assert.Nil(t, analyzeWebDAVStorageDefinition(def))
+	assert.Equal(t, "secret", def.Password)
+
+	artifact := path.Join(localDir, "site-20191201120000.tar.xz")
+	assert.Nil(t, ioutil.WriteFile(artifact, []byte("artifact"), 0644))
+	assert.Nil(t, storeFile(def, artifact))
+	assert.Nil(t, storeFile(def, artifact))
+
+	contents, err := ioutil.ReadFile(path.Join(remoteDir, "dav", "backups", "site", "site-20191201120000.tar.xz"))
+	assert.Nil(t, err)
+	assert.Equal(t, "artifact", string(contents))
+
+	assertStorageRoundTrip(t, def)
+
+	def.collectionsCreated = false
+	def.Password = "wrong"
+	assert.NotNil(t, storeFile(def, artifact))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// errNoStorageLeft stops generating an artifact which no storage accepts
+// anymore.
+var errNoStorageLeft = errors.New("all storages failed")
+
+// streamWriter tees an artifact to several storages while it is generated.
+// A storage which fails is dropped without affecting the others; as data is
+// written to each storage in turn, the slowest one sets the pace.
+type streamWriter struct {
+	pipes  []*io.PipeWriter
+	failed []bool
+	errs   []error
+	wg     sync.WaitGroup
+}
+
+func newStreamWriter(name string, storages []*StorageDefinition) *streamWriter {
+	w := &streamWriter{
+		pipes:  make([]*io.PipeWriter, len(storages)),
+		failed: make([]bool, len(storages)),
+		errs:   make([]error, len(storages)),
+	}
+
+	for i, storage := range storages {
+		pr, pw := io.Pipe()
+		w.pipes[i] = pw
+
+		w.wg.Add(1)
+		go func(i int, storage *StorageDefinition) {
+			defer w.wg.Done()
+
+			err := storage.Storage.Store(name, storage.throttle(pr), -1)
+			if err == nil {
+				// Anything left unread never made it to the storage
+				n, _ := io.Copy(ioutil.Discard, pr)
+				if n > 0 {
+					err = errors.New("storage stopped reading before the end of the artifact")
+				}
+			}
+
+			w.errs[i] = err
+			pr.CloseWithError(err)
+		}(i, storage)
+	}
+
+	return w
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	left := 0
+
+	for i, pipe := range w.pipes {
+		if w.failed[i] {
+			continue
+		}
+
+		_, err := pipe.Write(p)
+		if err != nil {
+			w.failed[i] = true
+			continue
+		}
+
+		left++
+	}
+
+	if left == 0 {
+		return 0, errNoStorageLeft
+	}
+
+	return len(p), nil
+}
+
+// Close finishes the artifact on all storages and waits for them. The
+// outcome of each storage is returned by Errors.
+func (w *streamWriter) Close() error {
+	for _, pipe := range w.pipes {
+		pipe.Close()
+	}
+
+	w.wg.Wait()
+
+	return nil
+}
+
+// Abort makes all storages discard the artifact.
+func (w *streamWriter) Abort(err error) {
+	for _, pipe := range w.pipes {
+		pipe.CloseWithError(err)
+	}
+
+	w.wg.Wait()
+}
+
+// Errors returns the error of each storage after Close or Abort.
+func (w *streamWriter) Errors() []error {
+	return w.errs
+}
+
+// streamArtifact generates an artifact straight into the given storages. It
+// returns the error of each storage, and the generation error unless it was
+// caused by all storages failing.
+func streamArtifact(storages []*StorageDefinition, generate func(output ArtifactOutput) error) ([]error, error) {
+	var writer *streamWriter
+
+	output := func(name string) (ArtifactWriter, error) {
+		writer = newStreamWriter(name, storages)
+		return writer, nil
+	}
+
+	err := generate(output)
+
+	if writer == nil {
+		return make([]error, len(storages)), err
+	}
+
+	if err != nil && errors.Cause(err) == errNoStorageLeft {
+		err = nil
+	}
+
+	return writer.Errors(), err
+}
+
+// StreamArtifacts generates every artifact once and pipes it to all storages
+// at the same time, without a local copy. A storage which fails is skipped
+// for the remaining artifacts. A failing data provider fails the backup.
+func (runner *BackupRunner) StreamArtifacts() ([]Artifact, []StorageResult, error) {
+	storages := runner.Backup.StorageDefinitions
+	results := make([]StorageResult, len(storages))
+	for i, storage := range storages {
+		results[i].Storage = storage
+	}
+
+	start := time.Now()
+	generators := runner.generators()
+
+	var artifacts []Artifact
+
+	for _, generator := range generators {
+		// Only storages which have not failed yet get the artifact
+		var active []int
+		var activeStorages []*StorageDefinition
+		for i := range results {
+			if results[i].Err == nil {
+				active = append(active, i)
+				activeStorages = append(activeStorages, storages[i])
+			}
+		}
+
+		if len(active) == 0 {
+			break
+		}
+
+		var artifact Artifact
+		var storeErrs []error
+		var err error
+
+		logVerbosef("Streaming %s", generator.Name)
+
+		artifact.Attempts, err = generator.Retry.Do("Generating "+generator.Name, func() error {
+			var err error
+			storeErrs, err = streamArtifact(activeStorages, func(output ArtifactOutput) error {
+				return generator.Generate(output, &artifact)
+			})
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Nothing to back up, e.g. a git repository without new commits
+		if len(artifact.Name) == 0 {
+			continue
+		}
+
+		artifacts = append(artifacts, artifact)
+
+		for j, i := range active {
+			results[i].Attempts++
+
+			if storeErrs[j] != nil {
+				results[i].Err = errors.Wrapf(storeErrs[j], "failed storing %s", artifact.Name)
+				continue
+			}
+
+			err := VerifyArtifact(storages[i], artifact)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+
+			results[i].Stored++
+		}
+	}
+
+	for i := range results {
+		results[i].Duration = time.Since(start)
+
+		if results[i].Err != nil {
+			continue
+		}
+
+		_, err := ApplyRetention(storages[i], runner.Time)
+		if err != nil {
+			results[i].Err = errors.Wrap(err, "failed applying retention policy")
+		}
+	}
+
+	return artifacts, results, nil
+}
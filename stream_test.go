@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	volume := path.Join(dir, "volume")
+	assert.Nil(t, os.Mkdir(volume, 0755))
+	assert.Nil(t, ioutil.WriteFile(path.Join(volume, "file"), []byte("streamed"), 0644))
+
+	var running, maxRunning int32
+
+	def := &BackupDefinition{
+		Version: VERSION,
+		Backup: Backup{
+			Name:   "stream",
+			Stream: true,
+			DataProviders: DataProviders{
+				VolumeDefinitions: []*VolumeDefinition{{
+					Name:                  "files",
+					Path:                  volume,
+					CompressionDefinition: &CompressionDefinition{Command: "gzip", Extension: "gz"},
+				}},
+			},
+			StorageDefinitions: []*StorageDefinition{
+				{Name: "first", LocalStorageDefinition: &LocalStorageDefinition{Path: path.Join(dir, "first")}},
+				{Name: "broken", Storage: &slowStorage{running: &running, maxRunning: &maxRunning, fail: true}},
+				{Name: "second", LocalStorageDefinition: &LocalStorageDefinition{Path: path.Join(dir, "second")}},
+			},
+		},
+	}
+	assert.Nil(t, AnalyzeBackupDefinition(def))
+
+	runner, err := NewBackupRunner(&def.Backup)
+	assert.Nil(t, err)
+	assert.Empty(t, runner.TempPath, "streaming needs no temporary directory")
+
+	artifacts, results, err := runner.StreamArtifacts()
+	assert.Nil(t, err)
+
+	if assert.Len(t, artifacts, 1) && assert.Len(t, results, 3) {
+		assert.Nil(t, results[0].Err)
+		assert.Equal(t, 1, results[0].Stored)
+		assert.NotNil(t, results[1].Err, "a failing storage must not affect the others")
+		assert.Nil(t, results[2].Err)
+		assert.Equal(t, 1, results[2].Stored)
+
+		for _, storage := range []string{"first", "second"} {
+			size, sum, err := hashFile(path.Join(dir, storage, artifacts[0].Name))
+			assert.Nil(t, err)
+			assert.Equal(t, artifacts[0].Size, size)
+			assert.Equal(t, artifacts[0].SHA256, sum)
+		}
+	}
+
+	// A failing data provider leaves nothing behind on the storages
+	def.Backup.DataProviders.VolumeDefinitions[0].Path = path.Join(dir, "missing")
+	def.Backup.StorageDefinitions = def.Backup.StorageDefinitions[:1]
+	runner.Time = runner.Time.Add(time.Second)
+
+	_, _, err = runner.StreamArtifacts()
+	assert.NotNil(t, err)
+
+	files, err := ioutil.ReadDir(path.Join(dir, "first"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestStreamArtifactFailingHalfway(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newFakeFTPServer(t)
+	defer server.Close()
+
+	ftpDef := &FTPStorageDefinition{Host: "127.0.0.1", Port: server.Port(), Path: "/backups"}
+	assert.Nil(t, analyzeFTPStorageDefinition(ftpDef))
+	defer ftpDef.Close()
+
+	rcloneDir := path.Join(dir, "rclone")
+	assert.Nil(t, os.Mkdir(rcloneDir, 0755))
+	rcloneDef := fakeRclone(t, rcloneDir)
+
+	localDef := &LocalStorageDefinition{Path: path.Join(dir, "local")}
+	assert.Nil(t, analyzeLocalStorageDefinition(localDef))
+
+	storages := []*StorageDefinition{
+		{Name: "ftp", Storage: ftpDef},
+		{Name: "rclone", Storage: rcloneDef},
+		{Name: "local", Storage: localDef},
+	}
+
+	const name = "db-20191201120000.sql.xz"
+
+	storeErrs, err := streamArtifact(storages, func(output ArtifactOutput) error {
+		return writeArtifact(output, &Artifact{Name: name}, func(w io.Writer) error {
+			w.Write(make([]byte, 64*1024))
+			return errors.New("dump failed")
+		})
+	})
+	assert.NotNil(t, err)
+
+	for i, storage := range storages {
+		assert.NotNil(t, storeErrs[i], storage.Name)
+	}
+
+	// No storage may keep a truncated artifact under its final name
+	_, ok := server.file("/backups/" + name)
+	assert.False(t, ok, "ftp")
+
+	_, err = os.Stat(path.Join(rcloneDir, name))
+	assert.True(t, os.IsNotExist(err), "rclone")
+
+	artifacts, err := localDef.List()
+	assert.Nil(t, err)
+	assert.Empty(t, artifacts, "local")
+}
@@ -0,0 +1,63 @@
+#!/bin/sh
+
+set -e
+
+echo "Starting Azurite container..."
+
+docker run --name test-azure -d -p 10000:10000 \
+  mcr.microsoft.com/azure-storage/azurite \
+  azurite-blob --blobHost 0.0.0.0 1>/dev/null
+
+CONNECTION_STRING="DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;"
+
+az() {
+  docker run --rm --network host mcr.microsoft.com/azure-cli az "$@" --connection-string "$CONNECTION_STRING"
+}
+
+printf "Waiting for Azurite to come online"
+
+set +e
+
+while true; do
+  az storage container create --name rika 1>/dev/null 2>&1
+
+  if [ $? -eq 0 ]; then
+    break
+  fi
+
+  printf "."
+  sleep 1
+done
+
+set -e
+
+echo ""
+
+rm -rf volume
+mkdir volume
+
+echo "Test File" > volume/file
+echo "Test File 2" > volume/file2
+
+echo "Running backup"
+../rika --verbose run test_azure.yaml
+
+cleanup() {
+    echo "Cleaning up"
+    docker rm -f test-azure 1>/dev/null
+    rm -rf volume
+}
+
+BLOBS=$(az storage blob list --container-name rika --prefix backups/ --query "[].name" --output tsv)
+
+if [ ! "$(echo "$BLOBS" | grep 'test-volume-.*\.tar\.xz')" ]; then
+    echo "Did not upload a .tar.xz blob!"
+    cleanup
+    exit 1
+fi
+
+echo "Success!"
+
+cleanup
+
+exit 0
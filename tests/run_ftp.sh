@@ -0,0 +1,55 @@
+#!/bin/sh
+
+set -e
+
+echo "Starting FTP container..."
+
+docker run --name test-ftp -d \
+  -p 2121:21 -p 21000-21010:21000-21010 \
+  -e USERS="test|test|/ftp/test" \
+  -e ADDRESS=localhost \
+  delfer/alpine-ftp-server 1>/dev/null
+
+printf "Waiting for FTP server to come online"
+
+while ! docker exec test-ftp sh -c "netstat -ltn | grep -q ':21 '" 2>/dev/null; do
+  printf "."
+  sleep 1
+done
+
+echo ""
+
+rm -rf volume
+mkdir volume
+
+echo "Test File" > volume/file
+echo "Test File 2" > volume/file2
+
+echo "Running backup"
+../rika --verbose run test_ftp.yaml
+
+cleanup() {
+    echo "Cleaning up"
+    docker rm -f test-ftp 1>/dev/null
+    rm -rf volume
+}
+
+ARTIFACT=$(docker exec test-ftp sh -c "ls /ftp/test/backups/rika/*.tar.xz" || true)
+
+if [ -z "$ARTIFACT" ]; then
+    echo "Did not upload a .tar.xz file!"
+    cleanup
+    exit 1
+fi
+
+if [ ! "$(docker exec test-ftp sh -c "xzcat $ARTIFACT | tar -xO" | grep 'Test File 2')" ]; then
+    echo "Wrong file contents"
+    cleanup
+    exit 1
+fi
+
+echo "Success!"
+
+cleanup
+
+exit 0
@@ -0,0 +1,52 @@
+#!/bin/sh
+
+set -e
+
+echo "Starting fake-gcs-server container..."
+
+rm -rf gcs-data
+mkdir -p gcs-data/rika
+
+docker run --name test-gcs -d -p 4443:4443 \
+  -v $(pwd)/gcs-data/:/data/ \
+  fsouza/fake-gcs-server -scheme http -external-url http://localhost:4443 1>/dev/null
+
+printf "Waiting for fake-gcs-server to come online"
+
+while ! curl -sf http://localhost:4443/storage/v1/b/rika 1>/dev/null; do
+  printf "."
+  sleep 1
+done
+
+echo ""
+
+rm -rf volume
+mkdir volume
+
+echo "Test File" > volume/file
+# Larger than the 1 MiB chunk size to exercise resumable uploads
+head -c 3000000 /dev/urandom > volume/random
+
+echo "Running backup"
+../rika --verbose run test_gcs.yaml
+
+cleanup() {
+    echo "Cleaning up"
+    docker rm -f test-gcs 1>/dev/null
+    rm -rf volume
+    rm -rf gcs-data
+}
+
+OBJECTS=$(curl -s "http://localhost:4443/storage/v1/b/rika/o?prefix=backups/")
+
+if [ ! "$(echo "$OBJECTS" | grep 'test-volume-.*\.tar\.xz')" ]; then
+    echo "Did not upload a .tar.xz object!"
+    cleanup
+    exit 1
+fi
+
+echo "Success!"
+
+cleanup
+
+exit 0
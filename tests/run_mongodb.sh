@@ -0,0 +1,51 @@
+#!/bin/sh
+
+set -e
+
+echo "Starting MongoDB container..."
+
+if [ ! "$(docker ps -a  | grep test-mongodb)" ]; then
+    docker run --name test-mongodb --health-cmd='mongosh --quiet --eval "db.runCommand({ping: 1})"' -e MONGO_INITDB_ROOT_USERNAME=test -e MONGO_INITDB_ROOT_PASSWORD=test -d mongo:latest 1>/dev/null
+else 
+    docker start test-mongodb 1>/dev/null
+fi
+
+printf "Waiting for database to start up"
+
+while [ ! $(docker inspect --format {{.State.Health.Status}} test-mongodb | grep healthy) ]; do
+    printf "%c" .
+    sleep 1
+done
+
+echo ""
+
+echo "Creating example document"
+docker exec test-mongodb mongosh -u test -p test --authenticationDatabase admin test --quiet --eval 'db.test.drop(); db.test.insertOne({test: "rika-1337"})' 1>/dev/null
+
+rm -rf ./storage
+
+echo "Running backup"
+../rika --verbose run test_mongodb.yaml
+
+cleanup() {
+    echo "Cleaning up"
+    docker rm -f test-mongodb 1>/dev/null
+}
+
+DUMPFILE=$(find storage -iname "*.archive.xz" -type f)
+
+if [ ! -f $DUMPFILE ]; then
+    echo "Did not produce a .archive.xz file!"
+    cleanup
+    exit 1
+fi
+
+if [ ! "$(xzcat $DUMPFILE | grep -a rika-1337 )" ]; then
+    echo "Dump file did not contain rika-1337"
+    cleanup
+    exit 1
+fi
+
+echo "Success!"
+
+cleanup
@@ -0,0 +1,45 @@
+#!/bin/sh
+
+set -e
+
+rm -rf rclone-data volume
+mkdir rclone-data volume
+
+cat > rclone.conf <<EOC
+[backup]
+type = alias
+remote = $(pwd)/rclone-data
+EOC
+
+echo "Test File" > volume/file
+echo "Test File 2" > volume/file2
+
+echo "Running backup"
+../rika --verbose run test_rclone.yaml
+
+cleanup() {
+    echo "Cleaning up"
+    rm -rf volume
+    rm -rf rclone-data
+    rm -f rclone.conf
+}
+
+DUMPFILE=$(find rclone-data/backups -iname "*.tar.xz" -type f)
+
+if [ ! -f "$DUMPFILE" ]; then
+    echo "Did not produce a .tar.xz file!"
+    cleanup
+    exit 1
+fi
+
+if [ ! "$(xzcat $DUMPFILE | tar -xO | grep 'Test File 2')" ]; then
+    echo "Wrong file contents"
+    cleanup
+    exit 1
+fi
+
+echo "Success!"
+
+cleanup
+
+exit 0
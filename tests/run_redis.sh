@@ -0,0 +1,51 @@
+#!/bin/sh
+
+set -e
+
+echo "Starting Redis container..."
+
+if [ ! "$(docker ps -a  | grep test-redis)" ]; then
+    docker run --name test-redis --health-cmd='redis-cli -a test --no-auth-warning ping' -d redis:latest redis-server --requirepass test 1>/dev/null
+else 
+    docker start test-redis 1>/dev/null
+fi
+
+printf "Waiting for database to start up"
+
+while [ ! $(docker inspect --format {{.State.Health.Status}} test-redis | grep healthy) ]; do
+    printf "%c" .
+    sleep 1
+done
+
+echo ""
+
+echo "Creating example key"
+docker exec test-redis redis-cli -a test --no-auth-warning SET test rika-1337 1>/dev/null
+
+rm -rf ./storage
+
+echo "Running backup"
+../rika --verbose run test_redis.yaml
+
+cleanup() {
+    echo "Cleaning up"
+    docker rm -f test-redis 1>/dev/null
+}
+
+DUMPFILE=$(find storage -iname "*.rdb.xz" -type f)
+
+if [ ! -f $DUMPFILE ]; then
+    echo "Did not produce a .rdb.xz file!"
+    cleanup
+    exit 1
+fi
+
+if [ ! "$(xzcat $DUMPFILE | grep -a rika-1337 )" ]; then
+    echo "Dump file did not contain rika-1337"
+    cleanup
+    exit 1
+fi
+
+echo "Success!"
+
+cleanup
@@ -0,0 +1,65 @@
+#!/bin/sh
+
+set -e
+
+echo "Starting MinIO container..."
+
+docker run --name test-s3 -d -p 9000:9000 \
+  -e MINIO_ROOT_USER=minioadmin \
+  -e MINIO_ROOT_PASSWORD=minioadmin \
+  minio/minio:latest server /data 1>/dev/null
+
+mc() {
+  docker run --rm --network host --entrypoint sh minio/mc:latest -c \
+    "mc alias set local http://localhost:9000 minioadmin minioadmin 1>/dev/null && mc $*"
+}
+
+printf "Waiting for MinIO to come online"
+
+set +e
+
+while true; do
+  mc ready local 1>/dev/null 2>&1
+
+  if [ $? -eq 0 ]; then
+    break
+  fi
+
+  printf "."
+  sleep 1
+done
+
+set -e
+
+echo ""
+
+mc mb local/rika 1>/dev/null
+
+rm -rf volume
+mkdir volume
+
+echo "Test File" > volume/file
+echo "Test File 2" > volume/file2
+
+echo "Running backup"
+../rika --verbose run test_s3.yaml
+
+cleanup() {
+    echo "Cleaning up"
+    docker rm -f test-s3 1>/dev/null
+    rm -rf volume
+}
+
+OBJECTS=$(mc ls --recursive local/rika/backups)
+
+if [ ! "$(echo "$OBJECTS" | grep 'test-volume-.*\.tar\.xz')" ]; then
+    echo "Did not upload a .tar.xz object!"
+    cleanup
+    exit 1
+fi
+
+echo "Success!"
+
+cleanup
+
+exit 0
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StorageResult is the outcome of storing a run's artifacts on one storage.
+type StorageResult struct {
+	Storage  *StorageDefinition
+	Stored   int
+	Attempts int
+	Duration time.Duration
+	Err      error
+}
+
+// storeArtifacts stores, verifies and applies the retention policy on a
+// single storage. Artifacts are stored one after another, the first failure
+// stops this storage without affecting the others.
+func (runner *BackupRunner) storeArtifacts(storage *StorageDefinition, artifacts []Artifact) StorageResult {
+	result := StorageResult{Storage: storage}
+	start := time.Now()
+
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	logVerbosef("Storing into %s", storage.Name)
+
+	for _, artifact := range artifacts {
+		artifactFullPath := path.Join(runner.TempPath, artifact.Name)
+		attempts, err := storage.RetryDefinition.Do(storage.Name+": storing "+artifact.Name, func() error {
+			return storage.StoreFile(artifactFullPath)
+		})
+		result.Attempts += attempts
+		if err != nil {
+			result.Err = errors.Wrapf(err, "failed storing %s", artifact.Name)
+			return result
+		}
+
+		if !GetOptions().DryRun {
+			err = VerifyArtifact(storage, artifact)
+			if err != nil {
+				result.Err = err
+				return result
+			}
+		}
+
+		result.Stored++
+	}
+
+	_, err := ApplyRetention(storage, runner.Time)
+	if err != nil {
+		result.Err = errors.Wrap(err, "failed applying retention policy")
+	}
+
+	return result
+}
+
+// StoreArtifacts stores the artifacts on all storages of the backup, running
+// at most Backup.Concurrency storages at once. The results are returned in the
+// order of the storage definitions.
+func (runner *BackupRunner) StoreArtifacts(artifacts []Artifact) []StorageResult {
+	storages := runner.Backup.StorageDefinitions
+	results := make([]StorageResult, len(storages))
+
+	concurrency := runner.Backup.Concurrency
+	if concurrency == 0 || concurrency > len(storages) {
+		concurrency = len(storages)
+	}
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, storage := range storages {
+		wg.Add(1)
+
+		go func(i int, storage *StorageDefinition) {
+			defer wg.Done()
+
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			results[i] = runner.storeArtifacts(storage, artifacts)
+		}(i, storage)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// ReportResults logs how many attempts the artifacts needed and the outcome
+// of every storage, and returns an error naming the storages that failed.
+func ReportResults(artifacts []Artifact, results []StorageResult) error {
+	for _, artifact := range artifacts {
+		if artifact.Attempts > 1 {
+			log.Printf("%s: generated after %d attempts", artifact.Name, artifact.Attempts)
+		}
+	}
+
+	var failed []string
+
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("%s: failed after %s (%d attempts): %s", result.Storage.Name, result.Duration.Round(time.Millisecond), result.Attempts, result.Err)
+			failed = append(failed, result.Storage.Name)
+			continue
+		}
+
+		log.Printf("%s: stored %d artifacts in %s (%d attempts)", result.Storage.Name, result.Stored, result.Duration.Round(time.Millisecond), result.Attempts)
+	}
+
+	if len(failed) > 0 {
+		return errors.Errorf("storing failed for %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowStorage accepts every artifact after a delay and records how many
+// Store calls of all slowStorages were running at the same time.
+type slowStorage struct {
+	running    *int32
+	maxRunning *int32
+	fail       bool
+}
+
+func (s *slowStorage) Store(artifact string, r io.Reader, size int64) error {
+	running := atomic.AddInt32(s.running, 1)
+	defer atomic.AddInt32(s.running, -1)
+
+	for {
+		max := atomic.LoadInt32(s.maxRunning)
+		if running <= max || atomic.CompareAndSwapInt32(s.maxRunning, max, running) {
+			break
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if s.fail {
+		return errors.New("link down")
+	}
+
+	return nil
+}
+
+func (s *slowStorage) List() ([]StoredArtifact, error)          { return nil, nil }
+func (s *slowStorage) Fetch(artifact string, w io.Writer) error { return nil }
+func (s *slowStorage) Delete(artifact string) error             { return nil }
+
+// tempArtifacts creates empty files for the artifacts in a new directory.
+func tempArtifacts(t *testing.T, artifacts []Artifact) string {
+	dir, err := ioutil.TempDir("", "rika-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, artifact := range artifacts {
+		assert.Nil(t, ioutil.WriteFile(path.Join(dir, artifact.Name), nil, 0644))
+	}
+
+	return dir
+}
+
+func TestStoreArtifactsConcurrently(t *testing.T) {
+	artifacts := []Artifact{{Name: "db-20191201120000.sql.xz"}, {Name: "files-20191201120000.tar.xz"}}
+	dir := tempArtifacts(t, artifacts)
+	defer os.RemoveAll(dir)
+
+	var running, maxRunning int32
+
+	var storages []*StorageDefinition
+	for _, name := range []string{"a", "b", "c", "d"} {
+		storages = append(storages, &StorageDefinition{
+			Name:    name,
+			Verify:  VerifyNone,
+			Storage: &slowStorage{running: &running, maxRunning: &maxRunning, fail: name == "b"},
+		})
+	}
+
+	runner := &BackupRunner{
+		TempPath: dir,
+		Backup:   &Backup{StorageDefinitions: storages, Concurrency: 2},
+		Time:     time.Now(),
+	}
+
+	results := runner.StoreArtifacts(artifacts)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxRunning), "concurrency limit should be used and respected")
+
+	if assert.Len(t, results, 4) {
+		for i, result := range results {
+			assert.Equal(t, storages[i], result.Storage, "results keep the order of the storages")
+		}
+
+		assert.NotNil(t, results[1].Err)
+		assert.Equal(t, 0, results[1].Stored)
+
+		for _, i := range []int{0, 2, 3} {
+			assert.Nil(t, results[i].Err, "a failing storage must not affect the others")
+			assert.Equal(t, 2, results[i].Stored)
+		}
+	}
+
+	err := ReportResults(artifacts, results)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "storing failed for b", err.Error())
+	}
+}
+
+// flakyStorage fails the first Store calls.
+type flakyStorage struct {
+	slowStorage
+	failures int
+}
+
+func (s *flakyStorage) Store(artifact string, r io.Reader, size int64) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("connection reset")
+	}
+
+	return nil
+}
+
+func TestStoreArtifactsRetries(t *testing.T) {
+	artifacts := []Artifact{{Name: "db-20191201120000.sql.xz"}}
+	dir := tempArtifacts(t, artifacts)
+	defer os.RemoveAll(dir)
+
+	retry := &RetryDefinition{Attempts: 3, InitialDelay: "1ms"}
+	assert.Nil(t, analyzeRetryDefinition(retry))
+
+	storages := []*StorageDefinition{
+		{Name: "recovers", Verify: VerifyNone, RetryDefinition: retry, Storage: &flakyStorage{failures: 2}},
+		{Name: "gives up", Verify: VerifyNone, RetryDefinition: retry, Storage: &flakyStorage{failures: 3}},
+	}
+
+	runner := &BackupRunner{
+		TempPath: dir,
+		Backup:   &Backup{StorageDefinitions: storages},
+		Time:     time.Now(),
+	}
+
+	results := runner.StoreArtifacts(artifacts)
+
+	assert.Nil(t, results[0].Err)
+	assert.Equal(t, 3, results[0].Attempts)
+
+	assert.NotNil(t, results[1].Err)
+	assert.Equal(t, 3, results[1].Attempts)
+}
+
+func TestStoreArtifactsVerifies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	artifactPath := path.Join(dir, "test-20191201120000.sql.xz")
+	assert.Nil(t, ioutil.WriteFile(artifactPath, []byte("artifact"), 0644))
+
+	artifact := Artifact{Name: "test-20191201120000.sql.xz"}
+	artifact.Size, artifact.SHA256, err = hashFile(artifactPath)
+	assert.Nil(t, err)
+
+	def := &StorageDefinition{
+		Name:                   "Local",
+		Verify:                 VerifyChecksum,
+		LocalStorageDefinition: &LocalStorageDefinition{Path: path.Join(dir, "storage")},
+	}
+	assert.Nil(t, analyzeStorageDefinition(def))
+
+	runner := &BackupRunner{
+		TempPath: dir,
+		Backup:   &Backup{StorageDefinitions: []*StorageDefinition{def}},
+		Time:     time.Now(),
+	}
+
+	results := runner.StoreArtifacts([]Artifact{artifact})
+	assert.Nil(t, results[0].Err)
+	assert.Nil(t, ReportResults([]Artifact{artifact}, results))
+
+	artifact.SHA256[0]++
+	results = runner.StoreArtifacts([]Artifact{artifact})
+	assert.NotNil(t, results[0].Err, "checksum mismatch should fail the storage")
+}
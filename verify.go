@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// VerifyChecksum reads the stored artifact back and compares its
+	// SHA-256 with the one computed while generating it. This downloads
+	// every artifact again, so it has to be asked for
+	VerifyChecksum = "checksum"
+	// VerifySize only compares the size of the stored artifact, which is
+	// cheap but does not detect corruption. This is the default
+	VerifySize = "size"
+	VerifyNone = "none"
+)
+
+func analyzeVerifyMode(def *StorageDefinition) error {
+	switch def.Verify {
+	case "":
+		def.Verify = VerifySize
+	case VerifyChecksum, VerifySize, VerifyNone:
+	default:
+		return errors.Errorf("invalid verify mode '%s', expected checksum, size or none", def.Verify)
+	}
+
+	return nil
+}
+
+func hashFile(fullpath string) (int64, []byte, error) {
+	file, err := os.Open(fullpath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return size, hash.Sum(nil), nil
+}
+
+func findStoredArtifact(storage Storage, name string) (*StoredArtifact, error) {
+	artifacts, err := storage.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "listing artifacts failed")
+	}
+
+	for _, stored := range artifacts {
+		if stored.Name == name {
+			return &stored, nil
+		}
+	}
+
+	return nil, errors.Errorf("%s is missing", name)
+}
+
+// VerifyArtifact checks that the copy of artifact on storage is intact,
+// according to the storage's verify mode.
+func VerifyArtifact(def *StorageDefinition, artifact Artifact) error {
+	return verifyArtifact(def, artifact, def.Verify)
+}
+
+// verifyArtifact checks the copy of artifact on storage with the given
+// verify mode.
+func verifyArtifact(def *StorageDefinition, artifact Artifact, mode string) error {
+	if mode == VerifyNone || artifact.SHA256 == nil {
+		return nil
+	}
+
+	logVerbosef("Verifying %s on %s (%s)", artifact.Name, def.Name, mode)
+
+	stored, err := findStoredArtifact(def.Storage, artifact.Name)
+	if err != nil {
+		return errors.Wrapf(err, "verification of %s failed", artifact.Name)
+	}
+
+	// Some rclone backends cannot tell the size and report -1, which leaves
+	// only the checksum to go by
+	if stored.Size >= 0 {
+		if stored.Size != artifact.Size {
+			return errors.Errorf("verification of %s failed: size is %d bytes, expected %d", artifact.Name, stored.Size, artifact.Size)
+		}
+
+		if mode == VerifySize {
+			return nil
+		}
+	}
+
+	hash := sha256.New()
+	err = def.Storage.Fetch(artifact.Name, hash)
+	if err != nil {
+		return errors.Wrapf(err, "verification of %s failed", artifact.Name)
+	}
+
+	if sum := hash.Sum(nil); !bytes.Equal(sum, artifact.SHA256) {
+		return errors.Errorf("verification of %s failed: SHA-256 is %s, expected %s",
+			artifact.Name, hex.EncodeToString(sum), hex.EncodeToString(artifact.SHA256))
+	}
+
+	return nil
+}
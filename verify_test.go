@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunCommandWithCompressedStdoutChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cdef := &CompressionDefinition{Command: "gzip", Extension: "gz"}
+	assert.Nil(t, analyzeCompressionDefinition(cdef))
+
+	fullPath := path.Join(dir, "test-20191201120000.txt.gz")
+	cmd := exec.Command("seq", "1", "100000")
+
+	artifact := Artifact{Name: "test-20191201120000.txt.gz"}
+	assert.Nil(t, RunCommandWithCompressedStdout(cmd, cdef, FileOutput(dir), &artifact))
+
+	size, sum, err := hashFile(fullPath)
+	assert.Nil(t, err)
+	assert.Equal(t, size, artifact.Size)
+	assert.Equal(t, sum, artifact.SHA256)
+}
+
+// sizelessStorage reports unknown sizes, like some rclone backends.
+type sizelessStorage struct {
+	*LocalStorageDefinition
+}
+
+func (s *sizelessStorage) List() ([]StoredArtifact, error) {
+	artifacts, err := s.LocalStorageDefinition.List()
+	for i := range artifacts {
+		artifacts[i].Size = -1
+	}
+	return artifacts, err
+}
+
+func TestVerifyArtifact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rika-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	artifactPath := path.Join(dir, "test-20191201120000.sql.xz")
+	assert.Nil(t, ioutil.WriteFile(artifactPath, []byte("intact artifact"), 0644))
+
+	artifact := Artifact{Name: "test-20191201120000.sql.xz"}
+	artifact.Size, artifact.SHA256, err = hashFile(artifactPath)
+	assert.Nil(t, err)
+
+	def := &StorageDefinition{
+		Name:                   "Local",
+		LocalStorageDefinition: &LocalStorageDefinition{Path: path.Join(dir, "storage")},
+	}
+	assert.Nil(t, analyzeStorageDefinition(def))
+	assert.Equal(t, VerifySize, def.Verify)
+	def.Verify = VerifyChecksum
+
+	assert.NotNil(t, VerifyArtifact(def, artifact), "missing artifact")
+
+	assert.Nil(t, def.StoreFile(artifactPath))
+	assert.Nil(t, VerifyArtifact(def, artifact))
+
+	storedPath := path.Join(def.LocalStorageDefinition.Path, artifact.Name)
+
+	// Same size, different contents
+	assert.Nil(t, ioutil.WriteFile(storedPath, []byte("broken artifact"), 0644))
+	assert.NotNil(t, VerifyArtifact(def, artifact))
+
+	def.Verify = VerifySize
+	assert.Nil(t, VerifyArtifact(def, artifact))
+
+	assert.Nil(t, ioutil.WriteFile(storedPath, []byte("intact"), 0644))
+	assert.NotNil(t, VerifyArtifact(def, artifact), "truncated artifact")
+
+	sizeless := &StorageDefinition{Name: "Sizeless", Verify: VerifySize, Storage: &sizelessStorage{def.LocalStorageDefinition}}
+	assert.NotNil(t, VerifyArtifact(sizeless, artifact), "falls back to the checksum without a size")
+	assert.Nil(t, def.StoreFile(artifactPath))
+	assert.Nil(t, VerifyArtifact(sizeless, artifact))
+
+	def.Verify = VerifyNone
+	assert.Nil(t, VerifyArtifact(def, artifact))
+
+	def.Verify = "md5"
+	assert.NotNil(t, analyzeStorageDefinition(def))
+}